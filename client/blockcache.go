@@ -0,0 +1,166 @@
+package client
+
+import (
+	"container/list"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	cacheBlockSize       int64 = 1 << 20
+	defaultCacheSize     int64 = 1 << 30
+	blockCacheTempPrefix       = ".tmp-"
+)
+
+var blockCaches = struct {
+	sync.Mutex
+	m map[string]*blockCache
+}{m: map[string]*blockCache{}}
+
+type cacheBlock struct {
+	key  string
+	size int64
+}
+
+// blockCache keeps fixed-size blocks of file content on disk, one file per
+// block, and evicts the least recently used blocks once it grows beyond its
+// size cap.
+type blockCache struct {
+	dir     string
+	maxSize int64
+
+	mu     sync.Mutex
+	size   int64
+	lru    *list.List
+	blocks map[string]*list.Element
+}
+
+// openBlockCache returns the block cache in dir. Clients configured with the
+// same directory share a cache, and the size cap of the first one applies.
+func openBlockCache(dir string, maxSize int64) (*blockCache, error) {
+	blockCaches.Lock()
+	defer blockCaches.Unlock()
+
+	dir = filepath.Clean(dir)
+	if c, ok := blockCaches.m[dir]; ok {
+		return c, nil
+	}
+	if maxSize <= 0 {
+		maxSize = defaultCacheSize
+	}
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	// pick up blocks from earlier runs, oldest first
+	var infos []os.FileInfo
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		if strings.HasPrefix(entry.Name(), blockCacheTempPrefix) {
+			os.Remove(filepath.Join(dir, entry.Name()))
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		infos = append(infos, info)
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].ModTime().Before(infos[j].ModTime())
+	})
+
+	c := &blockCache{
+		dir:     dir,
+		maxSize: maxSize,
+		lru:     list.New(),
+		blocks:  map[string]*list.Element{},
+	}
+	for _, info := range infos {
+		c.add(info.Name(), info.Size())
+	}
+
+	blockCaches.m[dir] = c
+	return c, nil
+}
+
+// get returns the block stored under key.
+func (c *blockCache) get(key string) ([]byte, bool) {
+	c.mu.Lock()
+	e, ok := c.blocks[key]
+	if ok {
+		c.lru.MoveToFront(e)
+	}
+	c.mu.Unlock()
+	if !ok {
+		return nil, false
+	}
+
+	data, err := os.ReadFile(filepath.Join(c.dir, key))
+	if err != nil {
+		// evicted in the meantime
+		return nil, false
+	}
+	return data, true
+}
+
+// put stores a block under key. Failures are logged, as the cache is only
+// an optimization.
+func (c *blockCache) put(key string, data []byte) {
+	f, err := os.CreateTemp(c.dir, blockCacheTempPrefix)
+	if err != nil {
+		log.Warn().Err(err).Msg("failed to write cache block")
+		return
+	}
+	_, err = f.Write(data)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), filepath.Join(c.dir, key))
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		log.Warn().Err(err).Msg("failed to write cache block")
+		return
+	}
+
+	c.add(key, int64(len(data)))
+}
+
+func (c *blockCache) add(key string, size int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.blocks[key]; ok {
+		c.size -= e.Value.(*cacheBlock).size
+		c.lru.Remove(e)
+	}
+	c.blocks[key] = c.lru.PushFront(&cacheBlock{key: key, size: size})
+	c.size += size
+
+	// evict the least recently used blocks
+	for c.size > c.maxSize {
+		e := c.lru.Back()
+		if e == nil {
+			return
+		}
+		b := e.Value.(*cacheBlock)
+		c.lru.Remove(e)
+		delete(c.blocks, b.key)
+		c.size -= b.size
+		os.Remove(filepath.Join(c.dir, b.key))
+	}
+}
@@ -25,7 +25,7 @@ func (c *Client) init() error {
 		c.drive.Client = c
 	})
 
-	return nil
+	return loadGlobal()
 }
 
 func (c *Client) User() (*UserClient, error) {
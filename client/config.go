@@ -6,11 +6,67 @@ import (
 	"sync"
 )
 
+// DeletePolicy decides what deleting an item through the FileSystem does.
+type DeletePolicy string
+
+const (
+	// DeleteTrash moves deleted items to the trash. This is the default.
+	DeleteTrash DeletePolicy = "trash"
+	// DeletePermanent deletes items permanently, bypassing the trash.
+	DeletePermanent DeletePolicy = "delete"
+	// DeleteDeny forbids deleting items.
+	DeleteDeny DeletePolicy = "deny"
+)
+
 type Config struct {
 	User struct {
 		Username string `json:"username"`
 		Password string `json:"password"`
 	} `json:"user"`
+	Delete  DeletePolicy `json:"delete,omitempty"`
+	Offline struct {
+		// Folder is the path offline downloads are saved to. If empty,
+		// PikPak's default download folder is used.
+		Folder string `json:"folder,omitempty"`
+	} `json:"offline"`
+	// VerifyDownloads checks the GCID of files downloaded from start to end,
+	// and aborts the download if it does not match.
+	VerifyDownloads bool `json:"verifyDownloads,omitempty"`
+	Download        struct {
+		// Connections splits GET downloads into this many concurrent range
+		// requests. 0 or 1 proxies a single request.
+		Connections int `json:"connections,omitempty"`
+		// SegmentSize is the size of each range request in bytes, 8 MiB if
+		// not set. At most Connections segments are held in memory.
+		SegmentSize int64 `json:"segmentSize,omitempty"`
+		// RetryTimeout is how many seconds requests to a busy download
+		// host are retried for, 30 if not set.
+		RetryTimeout int `json:"retryTimeout,omitempty"`
+		// Redirect answers GET requests with a redirect to the download
+		// link instead of proxying the content.
+		Redirect bool `json:"redirect,omitempty"`
+		// RedirectUserAgent limits redirects to clients whose User-Agent
+		// matches this regular expression. Others are proxied.
+		RedirectUserAgent string `json:"redirectUserAgent,omitempty"`
+	} `json:"download"`
+	Cache struct {
+		// Dir is where blocks of downloaded files are cached on disk. The
+		// cache is disabled if empty.
+		Dir string `json:"dir,omitempty"`
+		// Size caps the cache in bytes, 1 GiB if not set.
+		Size int64 `json:"size,omitempty"`
+	} `json:"cache"`
+	API struct {
+		// RequestsPerSecond limits the rate of drive API calls of the
+		// account, 5 if not set.
+		RequestsPerSecond float64 `json:"requestsPerSecond,omitempty"`
+		// Burst is how many calls can be made at once after a quiet
+		// period, 10 if not set.
+		Burst int `json:"burst,omitempty"`
+		// MaxInflight caps the number of concurrent drive API calls, 4 if
+		// not set.
+		MaxInflight int `json:"maxInflight,omitempty"`
+	} `json:"api"`
 	mutex sync.Mutex
 }
 
@@ -1,26 +1,47 @@
 package client
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
-	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
+	"net/url"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
+
+	"golang.org/x/sync/semaphore"
 )
 
 const (
 	driveAPIBaseURL = "https://api-drive.mypikpak.com"
 
-	listPrefix = driveAPIBaseURL + "/drive/v1/files?thumbnail_size=SIZE_MEDIUM&limit=1000&parent_id="
-	listSuffix = "&with_audit=true&filters=%7B%22trashed%22%3A%7B%22eq%22%3Afalse%7D%2C%22phase%22%3A%7B%22eq%22%3A%22PHASE_TYPE_COMPLETE%22%7D%7D"
+	listPrefix    = driveAPIBaseURL + "/drive/v1/files?thumbnail_size=SIZE_MEDIUM&limit=1000&parent_id="
+	listPageToken = "&page_token="
+	listSuffix    = "&with_audit=true&filters=%7B%22trashed%22%3A%7B%22eq%22%3Afalse%7D%2C%22phase%22%3A%7B%22eq%22%3A%22PHASE_TYPE_COMPLETE%22%7D%7D"
+
+	trashListSuffix = "&with_audit=true&filters=%7B%22trashed%22%3A%7B%22eq%22%3Atrue%7D%2C%22phase%22%3A%7B%22eq%22%3A%22PHASE_TYPE_COMPLETE%22%7D%7D"
 
 	fetchPrefix = driveAPIBaseURL + "/drive/v1/files/"
 	fetchSuffix = "?usage=FETCH"
 
-	trashURL = driveAPIBaseURL + "/drive/v1/files:batchTrash"
+	filesURL     = driveAPIBaseURL + "/drive/v1/files"
+	trashURL     = driveAPIBaseURL + "/drive/v1/files:batchTrash"
+	untrashURL   = driveAPIBaseURL + "/drive/v1/files:batchUntrash"
+	deleteURL    = driveAPIBaseURL + "/drive/v1/files:batchDelete"
+	batchMoveURL = driveAPIBaseURL + "/drive/v1/files:batchMove"
+	batchCopyURL = driveAPIBaseURL + "/drive/v1/files:batchCopy"
+
+	emptyTrashURL = driveAPIBaseURL + "/drive/v1/files/trash:empty"
+	aboutURL      = driveAPIBaseURL + "/drive/v1/about"
+
+	tasksURL        = driveAPIBaseURL + "/drive/v1/tasks"
+	tasksListPrefix = tasksURL + "?type=offline&thumbnail_size=SIZE_SMALL&limit=1000&filters=%7B%22phase%22%3A%7B%22in%22%3A%22PHASE_TYPE_RUNNING%2CPHASE_TYPE_ERROR%2CPHASE_TYPE_COMPLETE%2CPHASE_TYPE_PENDING%22%7D%7D&page_token="
+	tasksCancelURL  = tasksURL + "?delete_files=false&task_ids="
 )
 
 type DriveClient struct {
@@ -35,35 +56,64 @@ type DriveClient struct {
 
 type driveRoundTripper struct {
 	*DriveClient
+
+	limiter  *rateLimiter
+	inflight *semaphore.Weighted
 }
 
 func (p *driveRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
 	user, err := p.Client.User()
+	if err != nil {
+		return nil, err
+	}
 
 	for i := 0; i < 2; i++ {
+		// every attempt is signed on a copy of req, retries rewind the body
+		// the first attempt consumed
+		attempt := req.Clone(req.Context())
+		if i > 0 && req.Body != nil && req.Body != http.NoBody {
+			if req.GetBody == nil {
+				return nil, errors.New("cannot resend request body")
+			}
+			attempt.Body, err = req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		// signing calls the captcha API for every request, and may refresh
+		// the token, so it counts against the limits too
+		release, err := p.limitRequest(req.Context())
 		if err != nil {
 			return nil, err
 		}
 
-		err = user.SignRequest(req)
+		err = user.SignRequest(attempt)
 		if err != nil {
+			release()
 			return nil, err
 		}
 
-		req.Header.Set("origin", "https://mypikpak.com")
-		req.Header.Set("x-device-id", p.State.DeviceID)
+		attempt.Header.Set("origin", "https://mypikpak.com")
+		attempt.Header.Set("x-device-id", p.State.DeviceID)
 
-		resp, err := global.http.Transport.RoundTrip(req)
+		resp, err := global.http.Transport.RoundTrip(attempt)
 		if err != nil {
+			release()
 			return nil, err
 		}
 
 		if resp.StatusCode == http.StatusUnauthorized {
+			resp.Body.Close()
+			release()
 			p.user.logout()
 			continue
 		}
 
-		return resp, err
+		p.checkRateLimit(resp)
+		// the call is in flight until its response is read
+		resp.Body = &releaseBody{ReadCloser: resp.Body, release: release}
+		return resp, nil
 	}
 
 	return nil, errors.New("failed to sign request")
@@ -71,43 +121,160 @@ func (p *driveRoundTripper) RoundTrip(req *http.Request) (*http.Response, error)
 
 func (c *DriveClient) init() error {
 	c.initOnce.Do(func() {
+		cfg := c.Config.API
+		rate, burst, maxInflight := cfg.RequestsPerSecond, cfg.Burst, cfg.MaxInflight
+		if rate <= 0 {
+			rate = defaultAPIRate
+		}
+		if burst <= 0 {
+			burst = defaultAPIBurst
+		}
+		if maxInflight <= 0 {
+			maxInflight = defaultAPIMaxInflight
+		}
+
 		c.http = &http.Client{}
 		*c.http = *http.DefaultClient
-		c.http.Transport = &driveRoundTripper{c}
+		c.http.Transport = &driveRoundTripper{
+			DriveClient: c,
+			limiter:     newRateLimiter(rate, burst),
+			inflight:    semaphore.NewWeighted(int64(maxInflight)),
+		}
 	})
 	return nil
 }
 
+// doJSON sends a request with an optional JSON body through the signed
+// drive client and decodes the JSON response into out, if given.
+func (c *DriveClient) doJSON(ctx context.Context, method string, url string, in interface{}, out interface{}) error {
+	var reqBody io.Reader
+	if in != nil {
+		marshalled, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		reqBody = bytes.NewReader(marshalled)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, url, reqBody)
+	if err != nil {
+		return err
+	}
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != 200 {
+		return newAPIError(resp.StatusCode, body)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.Unmarshal(body, out)
+}
+
 type DriveFileList struct {
-	c     *DriveClient
-	Kind  string       `json:"kind"`
-	Files []*DriveItem `json:"files"`
+	c             *DriveClient
+	Kind          string       `json:"kind"`
+	NextPageToken string       `json:"next_page_token"`
+	Files         []*DriveItem `json:"files"`
 }
 
 func (l *DriveFileList) Get(name string) *DriveItem {
 	for _, f := range l.Files {
 		if f.Name == name {
-			f.c = l.c
 			return f
 		}
 	}
 	return nil
 }
 
+// trashFolderID lists every trashed item when used as a parent ID.
+const trashFolderID = "*"
+
 type DriveItem struct {
 	c            *DriveClient
+	trashed      bool
+	virtual      bool
+	content      []byte
 	Kind         string `json:"kind"`
 	ID           string `json:"id"`
 	ParentID     string `json:"parent_id"`
 	Name         string `json:"name"`
 	Size         string `json:"size"`
+	MimeType     string `json:"mime_type"`
 	CreatedTime  string `json:"created_time"`
 	ModifiedTime string `json:"modified_time"`
+	// Hash is PikPak's GCID of the content.
+	Hash        string `json:"hash"`
+	MD5Checksum string `json:"md5_checksum"`
+}
+
+type DriveLink struct {
+	URL    string `json:"url"`
+	Token  string `json:"token"`
+	Expire string `json:"expire"`
 }
 
 type DriveFile struct {
 	DriveFileList
-	WebContentLink string `json:"web_content_link"`
+	WebContentLink string                `json:"web_content_link"`
+	Links          map[string]*DriveLink `json:"links"`
+	Medias         []struct {
+		Link *DriveLink `json:"link"`
+	} `json:"medias"`
+}
+
+// linkExpiryParams are the query parameters download links carry their
+// expiry in, as a unix timestamp.
+var linkExpiryParams = []string{"e", "expire", "expires"}
+
+// Expiry returns when the first of the file's download links expires, or
+// the zero time if that is not known.
+func (f *DriveFile) Expiry() time.Time {
+	var expiry time.Time
+	earliest := func(t time.Time) {
+		if !t.IsZero() && (expiry.IsZero() || t.Before(expiry)) {
+			expiry = t
+		}
+	}
+
+	u, err := url.Parse(f.WebContentLink)
+	if err == nil {
+		query := u.Query()
+		for _, param := range linkExpiryParams {
+			ts, err := strconv.ParseInt(query.Get(param), 10, 64)
+			if err == nil && ts > 0 {
+				earliest(time.Unix(ts, 0))
+			}
+		}
+	}
+
+	links := make([]*DriveLink, 0, len(f.Links)+len(f.Medias))
+	for _, link := range f.Links {
+		links = append(links, link)
+	}
+	for _, media := range f.Medias {
+		links = append(links, media.Link)
+	}
+	for _, link := range links {
+		if link == nil {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, link.Expire)
+		if err == nil {
+			earliest(t)
+		}
+	}
+
+	return expiry
 }
 
 func (f *DriveItem) IsFolder() bool {
@@ -118,11 +285,38 @@ func (f *DriveItem) IsFile() bool {
 	return strings.Contains(f.Kind, "file")
 }
 
-func (f *DriveItem) List(ctx context.Context) (*DriveFileList, error) {
+// DriveFileIterator iterates over a folder listing one page at a time.
+type DriveFileIterator struct {
+	item  *DriveItem
+	token string
+	done  bool
+}
+
+// Iterate returns an iterator over the pages of the folder's listing.
+func (f *DriveItem) Iterate() (*DriveFileIterator, error) {
 	if !f.IsFolder() {
 		return nil, errors.New("not a folder")
 	}
-	req, err := http.NewRequestWithContext(ctx, "GET", listPrefix+f.ID+listSuffix, nil)
+	return &DriveFileIterator{
+		item: f,
+		// the trash is listed flat, the content of trashed folders is not
+		// browsable
+		done: f.trashed && f.ID != trashFolderID,
+	}, nil
+}
+
+// Next returns the next page of the listing, or io.EOF once all pages have
+// been returned.
+func (it *DriveFileIterator) Next(ctx context.Context) (*DriveFileList, error) {
+	if it.done {
+		return nil, io.EOF
+	}
+	f := it.item
+	suffix := listSuffix
+	if f.trashed {
+		suffix = trashListSuffix
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", listPrefix+f.ID+listPageToken+url.QueryEscape(it.token)+suffix, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -136,7 +330,7 @@ func (f *DriveItem) List(ctx context.Context) (*DriveFileList, error) {
 		return nil, err
 	}
 	if resp.StatusCode != 200 {
-		return nil, errors.New(string(body))
+		return nil, newAPIError(resp.StatusCode, body)
 	}
 	var list DriveFileList
 	err = json.Unmarshal(body, &list)
@@ -144,28 +338,91 @@ func (f *DriveItem) List(ctx context.Context) (*DriveFileList, error) {
 		return nil, err
 	}
 	list.c = f.c
+	for _, file := range list.Files {
+		// items are shared through caches once returned, set them up here
+		file.c = f.c
+		file.trashed = f.trashed
+	}
+	it.token = list.NextPageToken
+	it.done = it.token == ""
 	return &list, nil
 }
 
-func (f *DriveItem) Trash(ctx context.Context) error {
-	req, err := http.NewRequestWithContext(ctx, "POST", trashURL, strings.NewReader(fmt.Sprintf(`{"ids":["%s"]}`, f.ID)))
+// List returns the complete listing of the folder, following all pages.
+func (f *DriveItem) List(ctx context.Context) (*DriveFileList, error) {
+	it, err := f.Iterate()
 	if err != nil {
-		return err
+		return nil, err
 	}
-	req.Header.Set("Content-Type", "application/json")
-	resp, err := f.c.http.Do(req)
-	if err != nil {
-		return err
+	list := &DriveFileList{c: f.c}
+	for {
+		page, err := it.Next(ctx)
+		if err == io.EOF {
+			return list, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		list.Kind = page.Kind
+		list.Files = append(list.Files, page.Files...)
 	}
-	defer resp.Body.Close()
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return err
+}
+
+type batchTarget struct {
+	ParentID string `json:"parent_id"`
+}
+
+type batchRequest struct {
+	IDs []string     `json:"ids"`
+	To  *batchTarget `json:"to,omitempty"`
+}
+
+func (f *DriveItem) Trash(ctx context.Context) error {
+	return f.c.doJSON(ctx, "POST", trashURL, &batchRequest{IDs: []string{f.ID}}, nil)
+}
+
+// Untrash restores a trashed item to its original folder.
+func (f *DriveItem) Untrash(ctx context.Context) error {
+	return f.c.doJSON(ctx, "POST", untrashURL, &batchRequest{IDs: []string{f.ID}}, nil)
+}
+
+// Delete permanently deletes the item, bypassing the trash.
+func (f *DriveItem) Delete(ctx context.Context) error {
+	return f.c.doJSON(ctx, "POST", deleteURL, &batchRequest{IDs: []string{f.ID}}, nil)
+}
+
+// Move moves the item into the given folder, keeping its name.
+func (f *DriveItem) Move(ctx context.Context, parent *DriveItem) error {
+	if !parent.IsFolder() {
+		return errors.New("not a folder")
 	}
-	if resp.StatusCode != 200 {
-		return errors.New(string(body))
+	return f.c.doJSON(ctx, "POST", batchMoveURL, &batchRequest{
+		IDs: []string{f.ID},
+		To:  &batchTarget{ParentID: parent.ID},
+	}, nil)
+}
+
+// Copy copies the item, and everything below it, into the given folder. The
+// copy keeps the original name.
+func (f *DriveItem) Copy(ctx context.Context, parent *DriveItem) error {
+	if !parent.IsFolder() {
+		return errors.New("not a folder")
 	}
-	return nil
+	return f.c.doJSON(ctx, "POST", batchCopyURL, &batchRequest{
+		IDs: []string{f.ID},
+		To:  &batchTarget{ParentID: parent.ID},
+	}, nil)
+}
+
+// Rename changes the name of the item in place.
+func (f *DriveItem) Rename(ctx context.Context, name string) (*DriveItem, error) {
+	var item DriveItem
+	err := f.c.doJSON(ctx, "PATCH", fetchPrefix+f.ID, map[string]string{"name": name}, &item)
+	if err != nil {
+		return nil, err
+	}
+	item.c = f.c
+	return &item, nil
 }
 
 func (f *DriveItem) Fetch(ctx context.Context) (*DriveFile, error) {
@@ -183,7 +440,7 @@ func (f *DriveItem) Fetch(ctx context.Context) (*DriveFile, error) {
 		return nil, err
 	}
 	if resp.StatusCode != 200 {
-		return nil, errors.New(string(body))
+		return nil, newAPIError(resp.StatusCode, body)
 	}
 	var file DriveFile
 	err = json.Unmarshal(body, &file)
@@ -193,6 +450,71 @@ func (f *DriveItem) Fetch(ctx context.Context) (*DriveFile, error) {
 	return &file, nil
 }
 
+type objProvider struct {
+	Provider string `json:"provider"`
+}
+
+type uploadURL struct {
+	URL string `json:"url"`
+}
+
+type createFileRequest struct {
+	Kind        string       `json:"kind"`
+	ParentID    string       `json:"parent_id"`
+	Name        string       `json:"name"`
+	Size        string       `json:"size,omitempty"`
+	Hash        string       `json:"hash,omitempty"`
+	UploadType  string       `json:"upload_type,omitempty"`
+	ObjProvider *objProvider `json:"objProvider,omitempty"`
+	URL         *uploadURL   `json:"url,omitempty"`
+	FolderType  string       `json:"folder_type,omitempty"`
+}
+
+type createFileResponse struct {
+	UploadType string `json:"upload_type"`
+	Resumable  *struct {
+		Kind     string    `json:"kind"`
+		Provider string    `json:"provider"`
+		Params   ossParams `json:"params"`
+	} `json:"resumable"`
+	File *DriveItem   `json:"file"`
+	Task *OfflineTask `json:"task"`
+}
+
+// OfflineTask is a cloud download of a magnet or HTTP link.
+type OfflineTask struct {
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	Phase       string `json:"phase"`
+	Progress    int    `json:"progress"`
+	FileID      string `json:"file_id"`
+	FileName    string `json:"file_name"`
+	FileSize    string `json:"file_size"`
+	Message     string `json:"message"`
+	CreatedTime string `json:"created_time"`
+	UpdatedTime string `json:"updated_time"`
+}
+
+func (f *DriveItem) CreateFolder(ctx context.Context, name string) (*DriveItem, error) {
+	if !f.IsFolder() {
+		return nil, errors.New("not a folder")
+	}
+	var resp createFileResponse
+	err := f.c.doJSON(ctx, "POST", filesURL, &createFileRequest{
+		Kind:     "drive#folder",
+		ParentID: f.ID,
+		Name:     name,
+	}, &resp)
+	if err != nil {
+		return nil, err
+	}
+	if resp.File == nil {
+		return nil, errors.New("no file in response")
+	}
+	resp.File.c = f.c
+	return resp.File, nil
+}
+
 func (c *DriveClient) root() (*DriveItem, error) {
 	return &DriveItem{
 		c:    c,
@@ -200,6 +522,133 @@ func (c *DriveClient) root() (*DriveItem, error) {
 	}, nil
 }
 
+// EmptyTrash permanently deletes every trashed item.
+func (c *DriveClient) EmptyTrash(ctx context.Context) error {
+	c.mu.Lock()
+	err := c.init()
+	c.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	return c.doJSON(ctx, "PATCH", emptyTrashURL, nil, nil)
+}
+
+// AddOfflineTask starts a cloud download of link into parent. If parent is
+// nil, PikPak's default download folder is used.
+func (c *DriveClient) AddOfflineTask(ctx context.Context, parent *DriveItem, link string) (*OfflineTask, error) {
+	c.mu.Lock()
+	err := c.init()
+	c.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	req := &createFileRequest{
+		Kind:       "drive#file",
+		UploadType: "UPLOAD_TYPE_URL",
+		URL:        &uploadURL{URL: link},
+	}
+	if parent != nil && parent.ID != "" {
+		if !parent.IsFolder() {
+			return nil, errors.New("not a folder")
+		}
+		req.ParentID = parent.ID
+	} else {
+		req.FolderType = "DOWNLOAD"
+	}
+
+	var resp createFileResponse
+	err = c.doJSON(ctx, "POST", filesURL, req, &resp)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Task == nil {
+		return nil, errors.New("no task in response")
+	}
+	return resp.Task, nil
+}
+
+type DriveQuota struct {
+	Limit        string `json:"limit"`
+	Usage        string `json:"usage"`
+	UsageInTrash string `json:"usage_in_trash"`
+}
+
+type DriveAbout struct {
+	Quota DriveQuota `json:"quota"`
+}
+
+// About returns information about the drive, including its quota.
+func (c *DriveClient) About(ctx context.Context) (*DriveAbout, error) {
+	c.mu.Lock()
+	err := c.init()
+	c.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	var about DriveAbout
+	err = c.doJSON(ctx, "GET", aboutURL, nil, &about)
+	if err != nil {
+		return nil, err
+	}
+	return &about, nil
+}
+
+type offlineTaskList struct {
+	Tasks         []*OfflineTask `json:"tasks"`
+	NextPageToken string         `json:"next_page_token"`
+}
+
+// OfflineTasks lists the offline downloads of the account.
+func (c *DriveClient) OfflineTasks(ctx context.Context) ([]*OfflineTask, error) {
+	c.mu.Lock()
+	err := c.init()
+	c.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	var tasks []*OfflineTask
+	token := ""
+	for {
+		var page offlineTaskList
+		err = c.doJSON(ctx, "GET", tasksListPrefix+url.QueryEscape(token), nil, &page)
+		if err != nil {
+			return nil, err
+		}
+		tasks = append(tasks, page.Tasks...)
+		token = page.NextPageToken
+		if token == "" {
+			return tasks, nil
+		}
+	}
+}
+
+// CancelOfflineTask cancels an offline download. Files that were already
+// downloaded are kept.
+func (c *DriveClient) CancelOfflineTask(ctx context.Context, id string) error {
+	c.mu.Lock()
+	err := c.init()
+	c.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	return c.doJSON(ctx, "DELETE", tasksCancelURL+url.QueryEscape(id), nil, nil)
+}
+
+func (c *DriveClient) trashFolder() *DriveItem {
+	return &DriveItem{
+		c:       c,
+		trashed: true,
+		Kind:    "drive#folder",
+		ID:      trashFolderID,
+		Name:    ".trash",
+	}
+}
+
 func (c *DriveClient) Root() (*DriveItem, error) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
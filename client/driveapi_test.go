@@ -0,0 +1,42 @@
+package client
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestDriveFileExpiry(t *testing.T) {
+	soon := time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC)
+	later := soon.Add(time.Hour)
+	link := func(expire time.Time) *DriveLink {
+		return &DriveLink{Expire: expire.Format(time.RFC3339)}
+	}
+
+	tests := []struct {
+		name   string
+		file   DriveFile
+		expiry time.Time
+	}{
+		{"nothing", DriveFile{WebContentLink: "https://dl.example/f"}, time.Time{}},
+		{"e", DriveFile{WebContentLink: fmt.Sprintf("https://dl.example/f?e=%d&x=1", soon.Unix())}, soon},
+		{"expire", DriveFile{WebContentLink: fmt.Sprintf("https://dl.example/f?expire=%d", soon.Unix())}, soon},
+		{"expires", DriveFile{WebContentLink: fmt.Sprintf("https://dl.example/f?expires=%d", soon.Unix())}, soon},
+		{"earliest parameter", DriveFile{WebContentLink: fmt.Sprintf("https://dl.example/f?e=%d&expire=%d", later.Unix(), soon.Unix())}, soon},
+		{"invalid parameter", DriveFile{WebContentLink: "https://dl.example/f?e=soon"}, time.Time{}},
+		{"links", DriveFile{Links: map[string]*DriveLink{"a": link(later), "b": link(soon)}}, soon},
+		{"medias", DriveFile{Medias: []struct {
+			Link *DriveLink `json:"link"`
+		}{{Link: link(soon)}, {Link: nil}, {Link: link(later)}}}, soon},
+		{"link before parameter", DriveFile{
+			WebContentLink: fmt.Sprintf("https://dl.example/f?e=%d", later.Unix()),
+			Links:          map[string]*DriveLink{"a": link(soon)},
+		}, soon},
+		{"invalid link expiry", DriveFile{Links: map[string]*DriveLink{"a": {Expire: "tomorrow"}}}, time.Time{}},
+	}
+	for _, test := range tests {
+		if got := test.file.Expiry(); !got.Equal(test.expiry) {
+			t.Errorf("%s: Expiry() = %v, want %v", test.name, got, test.expiry)
+		}
+	}
+}
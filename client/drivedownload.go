@@ -0,0 +1,539 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	// linkExpiryMargin is how long before their expiry download links are
+	// dropped from the cache, so that a download is not started with a link
+	// that expires right away.
+	linkExpiryMargin = 5 * time.Minute
+
+	defaultDownloadRetryBudget = 30 * time.Second
+	busyRetryDelay             = 500 * time.Millisecond
+	busyRetryMaxDelay          = 8 * time.Second
+)
+
+var errDownloadBusy = fmt.Errorf("download host busy: %w", ErrRateLimited)
+
+// fileCacheTTL returns how long the download links of file can be cached.
+// Zero means they should not be cached at all.
+func fileCacheTTL(file *DriveFile) time.Duration {
+	expiry := file.Expiry()
+	if expiry.IsZero() {
+		return fileCacheTime
+	}
+	ttl := time.Until(expiry) - linkExpiryMargin
+	if ttl < 0 {
+		return 0
+	}
+	return ttl
+}
+
+// openDownload sends a request for the content of item, built by newRequest
+// from the download link. If the download host rejects the cached link as
+// expired, a fresh link is fetched and the request sent once more. If it is
+// busy, the request is retried with backoff until the retry budget is spent,
+// and the last busy response returned.
+func (d *FileSystem) openDownload(ctx context.Context, item *DriveItem, newRequest func(link string) (*http.Request, error)) (*http.Response, error) {
+	budget := time.Duration(d.c.Config.Download.RetryTimeout) * time.Second
+	if budget <= 0 {
+		budget = defaultDownloadRetryBudget
+	}
+	deadline := time.Now().Add(budget)
+
+	refetched := false
+	for retries := 0; ; {
+		file, err := d.cachedFetch(ctx, item)
+		if err != nil {
+			return nil, err
+		}
+		req, err := newRequest(file.WebContentLink)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := global.http.Do(req)
+		if err != nil {
+			return nil, err
+		}
+
+		switch resp.StatusCode {
+		case http.StatusForbidden, http.StatusGone:
+			if refetched {
+				return resp, nil
+			}
+			refetched = true
+			resp.Body.Close()
+			d.fileCache.Delete(item.ID)
+		case http.StatusServiceUnavailable, http.StatusTooManyRequests:
+			delay := busyBackoff(retries, resp.Header.Get("Retry-After"))
+			if time.Now().Add(delay).After(deadline) {
+				return resp, nil
+			}
+			resp.Body.Close()
+			log.Debug().Str("id", item.ID).Int("status", resp.StatusCode).Dur("delay", delay).Msg("download host busy, retrying")
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-time.After(delay):
+			}
+			retries++
+		default:
+			return resp, nil
+		}
+	}
+}
+
+// busyBackoff returns how long to wait before the next request to a busy
+// download host: exponential backoff with full jitter, or longer if the host
+// asks for it.
+func busyBackoff(retries int, retryAfter string) time.Duration {
+	max := busyRetryMaxDelay
+	if retries < 16 && busyRetryDelay<<retries < max {
+		max = busyRetryDelay << retries
+	}
+	delay := time.Duration(rand.Int63n(int64(max))) + 1
+	if seconds, err := strconv.Atoi(retryAfter); err == nil {
+		if d := time.Duration(seconds) * time.Second; d > delay {
+			delay = d
+		}
+	}
+	return delay
+}
+
+var (
+	defaultSegmentSize int64 = 8 << 20
+	downloadRetries          = 5
+	downloadRetryDelay       = 1 * time.Second
+)
+
+// segment is one range request of a segmented download.
+type segment struct {
+	start, end int64
+	data       []byte
+	err        error
+	done       chan struct{}
+}
+
+// segmentedReader reads a range of a file through concurrent range requests
+// and returns their content in order. At most a fixed number of segments are
+// fetched or buffered at any time.
+type segmentedReader struct {
+	cancel  context.CancelFunc
+	pending chan *segment
+	cur     []byte
+	// err is the error of the first failed segment, the content after it
+	// must not be handed out as if it followed on
+	err error
+}
+
+// openSegmented opens a segmented download of bytes start to end (inclusive)
+// of item over the given number of connections.
+func (d *FileSystem) openSegmented(ctx context.Context, item *DriveItem, start, end int64, connections int, segmentSize int64) io.ReadCloser {
+	if segmentSize <= 0 {
+		segmentSize = defaultSegmentSize
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	s := &segmentedReader{
+		cancel: cancel,
+		// one more segment is held by the reader
+		pending: make(chan *segment, connections-1),
+	}
+
+	go func() {
+		defer close(s.pending)
+		for off := start; off <= end; off += segmentSize {
+			seg := &segment{
+				start: off,
+				end:   off + segmentSize - 1,
+				done:  make(chan struct{}),
+			}
+			if seg.end > end {
+				seg.end = end
+			}
+			select {
+			case s.pending <- seg:
+			case <-ctx.Done():
+				return
+			}
+			go d.fetchSegment(ctx, item, seg)
+		}
+	}()
+
+	return s
+}
+
+func (d *FileSystem) fetchSegment(ctx context.Context, item *DriveItem, seg *segment) {
+	defer close(seg.done)
+
+	rc, err := d.openUpstream(ctx, item, seg.start, seg.end, 1)
+	if err != nil {
+		seg.err = err
+		return
+	}
+	defer rc.Close()
+
+	seg.data = make([]byte, seg.end-seg.start+1)
+	_, seg.err = io.ReadFull(rc, seg.data)
+}
+
+func (s *segmentedReader) Read(p []byte) (int, error) {
+	for len(s.cur) == 0 {
+		if s.err != nil {
+			return 0, s.err
+		}
+		seg, ok := <-s.pending
+		if !ok {
+			return 0, io.EOF
+		}
+		<-seg.done
+		if seg.err != nil {
+			s.cancel()
+			s.err = seg.err
+			return 0, seg.err
+		}
+		s.cur = seg.data
+	}
+	n := copy(p, s.cur)
+	s.cur = s.cur[n:]
+	return n, nil
+}
+
+func (s *segmentedReader) Close() error {
+	s.cancel()
+	for range s.pending {
+	}
+	return nil
+}
+
+// parseSingleRange parses a Range header of a single byte range into its
+// first and last byte. ok is false for anything else, such as multiple
+// ranges or unsatisfiable ones.
+func parseSingleRange(s string, size int64) (start, end int64, ok bool) {
+	if !strings.HasPrefix(s, "bytes=") || strings.Contains(s, ",") {
+		return 0, 0, false
+	}
+	first, last, found := strings.Cut(strings.TrimSpace(s[len("bytes="):]), "-")
+	if !found {
+		return 0, 0, false
+	}
+	first, last = strings.TrimSpace(first), strings.TrimSpace(last)
+
+	var err error
+	if first == "" {
+		// suffix range, the last n bytes
+		if size == 0 {
+			return 0, 0, false
+		}
+		n, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || n <= 0 {
+			return 0, 0, false
+		}
+		if n > size {
+			n = size
+		}
+		return size - n, size - 1, true
+	}
+	start, err = strconv.ParseInt(first, 10, 64)
+	if err != nil || start < 0 || start >= size {
+		return 0, 0, false
+	}
+	end = size - 1
+	if last != "" {
+		end, err = strconv.ParseInt(last, 10, 64)
+		if err != nil || end < start {
+			return 0, 0, false
+		}
+		if end >= size {
+			end = size - 1
+		}
+	}
+	return start, end, true
+}
+
+// openRange opens bytes start to end (inclusive) of item. Blocks are served
+// from the block cache if it is enabled, and the rest is downloaded over the
+// given number of connections.
+func (d *FileSystem) openRange(ctx context.Context, item *DriveItem, start, end int64, connections int) (io.ReadCloser, error) {
+	if d.blocks == nil || item.Hash == "" {
+		return d.openUpstream(ctx, item, start, end, connections)
+	}
+	r := &cachedReader{
+		fs:          d,
+		ctx:         ctx,
+		item:        item,
+		connections: connections,
+		pos:         start,
+		end:         end,
+	}
+	r.size, _ = strconv.ParseInt(item.Size, 10, 64)
+	// fail before anything is sent if the download does not work at all
+	err := r.next()
+	if err != nil {
+		r.Close()
+		return nil, err
+	}
+	return r, nil
+}
+
+// openUpstream opens bytes start to end (inclusive) of item on the download
+// host.
+func (d *FileSystem) openUpstream(ctx context.Context, item *DriveItem, start, end int64, connections int) (io.ReadCloser, error) {
+	if connections > 1 {
+		return d.openSegmented(ctx, item, start, end, connections, d.c.Config.Download.SegmentSize), nil
+	}
+	r := &resumingReader{
+		fs:   d,
+		ctx:  ctx,
+		item: item,
+		pos:  start,
+		end:  end,
+	}
+	err := r.reopen(0)
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// requestRange sends a single request for bytes start to end (inclusive) of
+// item.
+func (d *FileSystem) requestRange(ctx context.Context, item *DriveItem, start, end int64) (io.ReadCloser, error) {
+	resp, err := d.openDownload(ctx, item, func(link string) (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, link, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, end))
+		return req, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case resp.StatusCode == http.StatusServiceUnavailable || resp.StatusCode == http.StatusTooManyRequests:
+		resp.Body.Close()
+		return nil, errDownloadBusy
+	case resp.StatusCode != http.StatusPartialContent && !(resp.StatusCode == http.StatusOK && start == 0):
+		resp.Body.Close()
+		return nil, fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+	return resp.Body, nil
+}
+
+// resumable makes the body of a download response resume where it left off
+// if the connection drops. Responses that are not a single byte range of
+// item are returned as is.
+func (d *FileSystem) resumable(ctx context.Context, item *DriveItem, resp *http.Response) io.ReadCloser {
+	var start, end int64
+	switch resp.StatusCode {
+	case http.StatusOK:
+		if resp.ContentLength < 0 {
+			return resp.Body
+		}
+		end = resp.ContentLength - 1
+	case http.StatusPartialContent:
+		_, err := fmt.Sscanf(resp.Header.Get("Content-Range"), "bytes %d-%d/", &start, &end)
+		if err != nil {
+			return resp.Body
+		}
+	default:
+		return resp.Body
+	}
+	return &resumingReader{
+		fs:   d,
+		ctx:  ctx,
+		item: item,
+		rc:   resp.Body,
+		pos:  start,
+		end:  end,
+	}
+}
+
+// resumingReader reads bytes pos to end (inclusive) of a file, and sends a
+// new range request from where it left off when the connection drops or
+// ends early. Attempts that make no progress are limited and backed off.
+type resumingReader struct {
+	fs       *FileSystem
+	ctx      context.Context
+	item     *DriveItem
+	rc       io.ReadCloser
+	pos, end int64
+}
+
+func (r *resumingReader) Read(p []byte) (int, error) {
+	var err error
+	for attempt := 0; attempt <= downloadRetries; attempt++ {
+		if r.rc == nil {
+			if r.pos > r.end {
+				return 0, io.EOF
+			}
+			err = r.reopen(attempt)
+			if err != nil {
+				// a busy host was retried already
+				if r.ctx.Err() != nil || errors.Is(err, errDownloadBusy) {
+					return 0, err
+				}
+				continue
+			}
+		}
+
+		var n int
+		n, err = r.rc.Read(p)
+		r.pos += int64(n)
+		if err == nil || (err == io.EOF && r.pos > r.end) {
+			return n, err
+		}
+		r.rc.Close()
+		r.rc = nil
+		if n > 0 {
+			// hand out what arrived, and resume on the next read
+			return n, nil
+		}
+		if r.ctx.Err() != nil {
+			return 0, r.ctx.Err()
+		}
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		log.Debug().Err(err).Str("id", r.item.ID).Int64("offset", r.pos).Msg("download interrupted, resuming")
+	}
+	return 0, err
+}
+
+// reopen sends the range request for the rest of the file. Retries wait
+// before, and fetch a new download link in case the old one went bad.
+func (r *resumingReader) reopen(attempt int) error {
+	if attempt > 0 {
+		select {
+		case <-r.ctx.Done():
+			return r.ctx.Err()
+		case <-time.After(downloadRetryDelay << (attempt - 1)):
+		}
+		r.fs.fileCache.Delete(r.item.ID)
+	}
+	rc, err := r.fs.requestRange(r.ctx, r.item, r.pos, r.end)
+	if err != nil {
+		return err
+	}
+	r.rc = rc
+	return nil
+}
+
+func (r *resumingReader) Close() error {
+	if r.rc != nil {
+		return r.rc.Close()
+	}
+	return nil
+}
+
+// cachedReader reads a range of a file block by block through the block
+// cache. Missing blocks are read from a single download that runs to the end
+// of the range, and is only restarted when a cached block is skipped.
+type cachedReader struct {
+	fs          *FileSystem
+	ctx         context.Context
+	item        *DriveItem
+	connections int
+	size        int64
+	pos, end    int64
+
+	block []byte
+	rc    io.ReadCloser
+	rcPos int64
+}
+
+func (r *cachedReader) Read(p []byte) (int, error) {
+	if len(r.block) == 0 {
+		if r.pos > r.end {
+			return 0, io.EOF
+		}
+		err := r.next()
+		if err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.block)
+	r.block = r.block[n:]
+	r.pos += int64(n)
+	return n, nil
+}
+
+// next loads the part of the block at r.pos that is within the range.
+func (r *cachedReader) next() error {
+	index := r.pos / cacheBlockSize
+	start := index * cacheBlockSize
+	key := fmt.Sprintf("%s.%s.%d", r.item.ID, r.item.Hash, index)
+
+	block, ok := r.fs.blocks.get(key)
+	if !ok {
+		var err error
+		block, err = r.download(start)
+		if err != nil {
+			return err
+		}
+		r.fs.blocks.put(key, block)
+	}
+
+	if int64(len(block)) > r.end-start+1 {
+		block = block[:r.end-start+1]
+	}
+	if int64(len(block)) <= r.pos-start {
+		return io.ErrUnexpectedEOF
+	}
+	r.block = block[r.pos-start:]
+	return nil
+}
+
+// download reads the whole block starting at start from the download host.
+func (r *cachedReader) download(start int64) ([]byte, error) {
+	if r.rc != nil && r.rcPos != start {
+		r.rc.Close()
+		r.rc = nil
+	}
+	if r.rc == nil {
+		// cover whole blocks, so that the last one can be cached as well
+		end := (r.end/cacheBlockSize+1)*cacheBlockSize - 1
+		if end >= r.size {
+			end = r.size - 1
+		}
+		rc, err := r.fs.openUpstream(r.ctx, r.item, start, end, r.connections)
+		if err != nil {
+			return nil, err
+		}
+		r.rc = rc
+		r.rcPos = start
+	}
+
+	n := cacheBlockSize
+	if start+n > r.size {
+		n = r.size - start
+	}
+	block := make([]byte, n)
+	_, err := io.ReadFull(r.rc, block)
+	if err != nil {
+		r.rc.Close()
+		r.rc = nil
+		return nil, err
+	}
+	r.rcPos += n
+	return block, nil
+}
+
+func (r *cachedReader) Close() error {
+	if r.rc != nil {
+		return r.rc.Close()
+	}
+	return nil
+}
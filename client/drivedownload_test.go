@@ -0,0 +1,197 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestParseSingleRange(t *testing.T) {
+	tests := []struct {
+		header     string
+		size       int64
+		start, end int64
+		ok         bool
+	}{
+		{"bytes=0-99", 1000, 0, 99, true},
+		{"bytes=100-", 1000, 100, 999, true},
+		{"bytes= 100 - 199 ", 1000, 100, 199, true},
+		{"bytes=-100", 1000, 900, 999, true},
+		{"bytes=-5000", 1000, 0, 999, true},
+		{"bytes=900-5000", 1000, 900, 999, true},
+		{"bytes=1000-", 1000, 0, 0, false},
+		{"bytes=1000-1100", 1000, 0, 0, false},
+		{"bytes=200-100", 1000, 0, 0, false},
+		{"bytes=-0", 1000, 0, 0, false},
+		{"bytes=-1", 0, 0, 0, false},
+		{"bytes=0-", 0, 0, 0, false},
+		{"bytes=0-1,5-6", 1000, 0, 0, false},
+		{"bytes=0", 1000, 0, 0, false},
+		{"bytes=a-b", 1000, 0, 0, false},
+		{"items=0-1", 1000, 0, 0, false},
+		{"", 1000, 0, 0, false},
+	}
+	for _, test := range tests {
+		start, end, ok := parseSingleRange(test.header, test.size)
+		if ok != test.ok || (ok && (start != test.start || end != test.end)) {
+			t.Errorf("parseSingleRange(%q, %d) = %d, %d, %v, want %d, %d, %v",
+				test.header, test.size, start, end, ok, test.start, test.end, test.ok)
+		}
+	}
+}
+
+// testDownload serves content as a download host, answering range requests
+// in random order. Requests for bytes from failAt on fail.
+type testDownload struct {
+	content []byte
+	failAt  int64
+	hits    atomic.Int32
+}
+
+func (d *testDownload) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	d.hits.Add(1)
+	var start, end int64
+	fmt.Sscanf(r.Header.Get("Range"), "bytes=%d-%d", &start, &end)
+	if d.failAt >= 0 && start <= d.failAt && d.failAt <= end {
+		http.Error(w, "broken", http.StatusInternalServerError)
+		return
+	}
+	// completions come out of order
+	time.Sleep(time.Duration(rand.Intn(5)) * time.Millisecond)
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(d.content))
+}
+
+// newTestDownload returns a FileSystem whose file "f" is served by dl.
+func newTestDownload(t *testing.T, dl http.Handler) *FileSystem {
+	host := httptest.NewServer(dl)
+	t.Cleanup(host.Close)
+	drive := &fakeDrive{
+		items: map[string]*DriveItem{},
+		fetch: func(id string) *DriveFile {
+			return &DriveFile{WebContentLink: host.URL + "/" + id}
+		},
+	}
+	return newTestFileSystem(t, drive)
+}
+
+func testContent(n int) []byte {
+	content := make([]byte, n)
+	rand.New(rand.NewSource(1)).Read(content)
+	return content
+}
+
+func TestSegmentedReader(t *testing.T) {
+	dl := &testDownload{content: testContent(100000), failAt: -1}
+	fs := newTestDownload(t, dl)
+	item := &DriveItem{c: fs.c, Kind: "drive#file", ID: "f", Size: "100000"}
+
+	r := fs.openSegmented(context.Background(), item, 1234, 98765, 4, 1000)
+	defer r.Close()
+	got, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, dl.content[1234:98766]) {
+		t.Error("segments reassembled out of order")
+	}
+}
+
+func TestSegmentedReaderErrorSticks(t *testing.T) {
+	retryDelay := downloadRetryDelay
+	downloadRetryDelay = time.Millisecond
+	defer func() { downloadRetryDelay = retryDelay }()
+
+	dl := &testDownload{content: testContent(10000), failAt: 3500}
+	fs := newTestDownload(t, dl)
+	item := &DriveItem{c: fs.c, Kind: "drive#file", ID: "f", Size: "10000"}
+
+	r := fs.openSegmented(context.Background(), item, 0, 9999, 4, 1000)
+	defer r.Close()
+	got, err := io.ReadAll(r)
+	if err == nil {
+		t.Fatal("read past a failed segment")
+	}
+	if !bytes.Equal(got, dl.content[:3000]) {
+		t.Errorf("read %d bytes before the error, want the 3000 before the failed segment", len(got))
+	}
+	for i := 0; i < 3; i++ {
+		n, err2 := r.Read(make([]byte, 100))
+		if n != 0 || err2 != err {
+			t.Errorf("Read after the error = %d, %v, want 0, %v", n, err2, err)
+		}
+	}
+}
+
+func TestFileCacheTTL(t *testing.T) {
+	expiring := func(d time.Duration) *DriveFile {
+		return &DriveFile{WebContentLink: fmt.Sprintf("https://dl.example/f?e=%d", time.Now().Add(d).Unix())}
+	}
+
+	if ttl := fileCacheTTL(&DriveFile{}); ttl != fileCacheTime {
+		t.Errorf("TTL without expiry = %v, want %v", ttl, fileCacheTime)
+	}
+	if ttl := fileCacheTTL(expiring(linkExpiryMargin / 2)); ttl != 0 {
+		t.Errorf("TTL of a link about to expire = %v, want 0", ttl)
+	}
+	if ttl := fileCacheTTL(expiring(-time.Hour)); ttl != 0 {
+		t.Errorf("TTL of an expired link = %v, want 0", ttl)
+	}
+	want := time.Hour - linkExpiryMargin
+	if ttl := fileCacheTTL(expiring(time.Hour)); ttl < want-2*time.Second || ttl > want {
+		t.Errorf("TTL of a link valid for an hour = %v, want %v", ttl, want)
+	}
+}
+
+func TestOpenDownloadRefetch(t *testing.T) {
+	for _, status := range []int{http.StatusForbidden, http.StatusGone} {
+		for _, good := range []bool{true, false} {
+			var fetches atomic.Int32
+			host := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				// only links fetched after the first are accepted
+				if !good || r.URL.Query().Get("gen") == "1" {
+					w.WriteHeader(status)
+					return
+				}
+				w.Write([]byte("content"))
+			}))
+			defer host.Close()
+			drive := &fakeDrive{
+				items: map[string]*DriveItem{},
+				fetch: func(id string) *DriveFile {
+					gen := fetches.Add(1)
+					// valid for long, so that it is cached
+					expire := time.Now().Add(time.Hour).Unix()
+					return &DriveFile{WebContentLink: fmt.Sprintf("%s/%s?gen=%d&e=%d", host.URL, id, gen, expire)}
+				},
+			}
+			fs := newTestFileSystem(t, drive)
+			item := &DriveItem{c: fs.c, Kind: "drive#file", ID: "f", Size: "7"}
+
+			resp, err := fs.openDownload(context.Background(), item, func(link string) (*http.Request, error) {
+				return http.NewRequest("GET", link, nil)
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+
+			want := http.StatusOK
+			if !good {
+				want = status
+			}
+			if resp.StatusCode != want {
+				t.Errorf("%d, refetch works %v: got status %d, want %d", status, good, resp.StatusCode, want)
+			}
+			if n := fetches.Load(); n != 2 {
+				t.Errorf("%d, refetch works %v: link fetched %d times, want 2", status, good, n)
+			}
+		}
+	}
+}
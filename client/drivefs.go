@@ -4,16 +4,21 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"mime"
 	"net/http"
 	"os"
+	"path"
 	"regexp"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/jellydator/ttlcache/v3"
+	"github.com/rs/zerolog/log"
 	"golang.org/x/net/webdav"
+	"golang.org/x/sync/singleflight"
 )
 
 var (
@@ -21,6 +26,11 @@ var (
 	listCacheTime    = 1 * time.Minute
 	fileCacheTime    = 1 * time.Minute
 	itemCacheTime    = 1 * time.Minute
+	aboutCacheTime   = 1 * time.Minute
+
+	// sharedCallTimeout bounds API calls shared by concurrent requests, as
+	// they do not end with the request that started them.
+	sharedCallTimeout = 1 * time.Minute
 )
 
 type fileStat struct {
@@ -59,51 +69,191 @@ func (f *fileStat) Sys() interface{} {
 	return nil
 }
 
+// ETag implements webdav.ETager. It is taken from the content hash where
+// there is one, and from the ID and modification time otherwise.
+func (f *fileStat) ETag(ctx context.Context) (string, error) {
+	if f.f.Hash != "" {
+		return `"` + f.f.Hash + `"`, nil
+	}
+	return fmt.Sprintf(`"%s-%x-%x"`, f.f.ID, f.ModTime().UnixNano(), f.Size()), nil
+}
+
+// ContentType implements webdav.ContentTyper, so that x/net/webdav does not
+// read the start of every file to sniff it.
+func (f *fileStat) ContentType(ctx context.Context) (string, error) {
+	if f.f.MimeType != "" {
+		return f.f.MimeType, nil
+	}
+	if t := mime.TypeByExtension(path.Ext(f.f.Name)); t != "" {
+		return t, nil
+	}
+	return "application/octet-stream", nil
+}
+
 type FileSystem struct {
-	c         *DriveClient
-	itemCache *ttlcache.Cache[string, *DriveItem]
-	listCache *ttlcache.Cache[string, *DriveFileList]
-	fileCache *ttlcache.Cache[string, *DriveFile]
-	mu        sync.RWMutex
+	c          *DriveClient
+	itemCache  *ttlcache.Cache[string, *DriveItem]
+	listCache  *ttlcache.Cache[string, *DriveFileList]
+	fileCache  *ttlcache.Cache[string, *DriveFile]
+	aboutCache *ttlcache.Cache[string, *DriveAbout]
+	blocks     *blockCache
+	lists      singleflight.Group
+	fetches    singleflight.Group
+	// locks serializes mutations of the same path
+	locks pathLocks
+	// listMu guards updates of cached listings made in place
+	listMu sync.Mutex
+	// epoch changes whenever cached entries are dropped or updated, so that
+	// results of API calls started before that are not cached
+	epoch atomic.Uint64
 }
 
 func (d *FileSystem) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
-	return os.ErrPermission
+	name = sanitizeName(name)
+
+	if name == "" {
+		return os.ErrExist
+	}
+	if isTrashPath(name) || isOfflinePath(name) {
+		return os.ErrPermission
+	}
+
+	defer d.locks.lock(name)()
+
+	parentName, base := splitPath(name)
+	parent, err := d.getDriveItem(ctx, parentName)
+	if err != nil {
+		return err
+	}
+	if parent == nil || !parent.IsFolder() {
+		return os.ErrNotExist
+	}
+
+	item, err := d.getDriveItem(ctx, name)
+	if err != nil {
+		return err
+	}
+	if item != nil {
+		return os.ErrExist
+	}
+
+	created, err := parent.CreateFolder(ctx, base)
+	if err != nil {
+		return err
+	}
+
+	d.cacheChild(parent, name, created)
+	return nil
+}
+
+// cacheChild records a newly created item under its path, and appends it to
+// a copy of the parent's cached listing so that it shows up right away.
+func (d *FileSystem) cacheChild(parent *DriveItem, name string, child *DriveItem) {
+	d.listMu.Lock()
+	defer d.listMu.Unlock()
+
+	d.epoch.Add(1)
+	d.itemCache.Set(name, child, itemCacheTime)
+
+	cached := d.listCache.Get(parent.ID)
+	if cached == nil {
+		return
+	}
+	list := *cached.Value()
+	list.Files = append(list.Files[:len(list.Files):len(list.Files)], child)
+	d.listCache.Set(parent.ID, &list, listCacheTime)
 }
 
 func (d *FileSystem) cachedList(ctx context.Context, item *DriveItem) (*DriveFileList, error) {
-	var err error
-	var dir *DriveFileList
+	dir, ok, err := d.offlineList(ctx, item)
+	if ok {
+		return dir, err
+	}
+
 	cached := d.listCache.Get(item.ID)
 	if cached != nil {
-		dir = cached.Value()
-	} else {
-		dir, err = item.List(ctx)
+		return cached.Value(), nil
+	}
+	// listings started before a change are not shared with later callers
+	epoch := d.epoch.Load()
+	key := item.ID + "@" + strconv.FormatUint(epoch, 10)
+	return shared(ctx, &d.lists, key, func(ctx context.Context) (*DriveFileList, error) {
+		dir, err := item.List(ctx)
 		if err != nil {
 			return nil, err
 		}
-		d.listCache.Set(item.ID, dir, listCacheTime)
-	}
-	return dir, nil
+		d.listMu.Lock()
+		if d.epoch.Load() == epoch {
+			d.listCache.Set(item.ID, dir, listCacheTime)
+		}
+		d.listMu.Unlock()
+		return dir, nil
+	})
 }
 
 func (d *FileSystem) cachedFetch(ctx context.Context, item *DriveItem) (*DriveFile, error) {
-	d.mu.Lock()
-	defer d.mu.Unlock()
-
-	var err error
-	var file *DriveFile
 	cached := d.fileCache.Get(item.ID)
 	if cached != nil {
-		file = cached.Value()
-	} else {
-		file, err = item.Fetch(ctx)
+		return cached.Value(), nil
+	}
+	return shared(ctx, &d.fetches, item.ID, func(ctx context.Context) (*DriveFile, error) {
+		file, err := item.Fetch(ctx)
 		if err != nil {
 			return nil, err
 		}
-		d.fileCache.Set(item.ID, file, fileCacheTime)
+		ttl := fileCacheTTL(file)
+		if ttl > 0 {
+			d.fileCache.Set(item.ID, file, ttl)
+		}
+		return file, nil
+	})
+}
+
+// detachedContext carries the values of a context, but not its deadline or
+// cancellation.
+type detachedContext struct {
+	context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (detachedContext) Done() <-chan struct{}       { return nil }
+func (detachedContext) Err() error                  { return nil }
+
+// shared runs fn once for all concurrent callers with the same key, so that
+// e.g. a folder scanned by many clients at once is listed only once. fn runs
+// on a context detached from the callers, as one of them giving up must not
+// fail the others, and each caller stops waiting when its own context is
+// done.
+func shared[T any](ctx context.Context, g *singleflight.Group, key string, fn func(ctx context.Context) (T, error)) (T, error) {
+	ch := g.DoChan(key, func() (interface{}, error) {
+		ctx, cancel := context.WithTimeout(detachedContext{ctx}, sharedCallTimeout)
+		defer cancel()
+		return fn(ctx)
+	})
+
+	var zero T
+	select {
+	case <-ctx.Done():
+		return zero, ctx.Err()
+	case res := <-ch:
+		if res.Err != nil {
+			return zero, res.Err
+		}
+		return res.Val.(T), nil
 	}
-	return file, nil
+}
+
+func (d *FileSystem) cachedAbout(ctx context.Context) (*DriveAbout, error) {
+	cached := d.aboutCache.Get("")
+	if cached != nil {
+		return cached.Value(), nil
+	}
+	about, err := d.c.About(ctx)
+	if err != nil {
+		return nil, err
+	}
+	d.aboutCache.Set("", about, aboutCacheTime)
+	return about, nil
 }
 
 func (d *FileSystem) driveItemToFile(ctx context.Context, item *DriveItem) (*File, error) {
@@ -121,8 +271,13 @@ func (d *FileSystem) driveItemToFile(ctx context.Context, item *DriveItem) (*Fil
 	}, nil
 }
 
-func (d *FileSystem) walkTo(ctx context.Context, target string, curPath string, curItem *DriveItem) (*DriveItem, error) {
-	d.itemCache.Set(curPath, curItem, itemCacheTime)
+// walkTo looks up target from curItem at curPath, caching the items on the
+// way unless the cache changed since epoch.
+func (d *FileSystem) walkTo(ctx context.Context, epoch uint64, target string, curPath string, curItem *DriveItem) (*DriveItem, error) {
+	// virtual items are cheap to look up again, and may change quickly
+	if !curItem.virtual {
+		d.cacheItem(epoch, curPath, curItem)
+	}
 
 	if target == curPath {
 		return curItem, nil
@@ -152,11 +307,21 @@ func (d *FileSystem) walkTo(ctx context.Context, target string, curPath string,
 		nextItem = dir.Get(next)
 	}
 	if nextItem == nil {
-		d.itemCache.Set(nextPath, nil, itemCacheTime)
+		if !curItem.virtual {
+			d.cacheItem(epoch, nextPath, nil)
+		}
 		return nil, nil
 	}
 
-	return d.walkTo(ctx, target, nextPath, nextItem)
+	return d.walkTo(ctx, epoch, target, nextPath, nextItem)
+}
+
+func (d *FileSystem) cacheItem(epoch uint64, name string, item *DriveItem) {
+	d.listMu.Lock()
+	defer d.listMu.Unlock()
+	if d.epoch.Load() == epoch {
+		d.itemCache.Set(name, item, itemCacheTime)
+	}
 }
 
 func sanitizeName(name string) string {
@@ -166,6 +331,11 @@ func sanitizeName(name string) string {
 	return name
 }
 
+// splitPath splits a sanitized path into its parent path and base name.
+func splitPath(name string) (string, string) {
+	return sanitizeName(path.Dir(name)), path.Base(name)
+}
+
 func (d *FileSystem) getDriveItem(ctx context.Context, name string) (*DriveItem, error) {
 	name = sanitizeName(name)
 
@@ -177,11 +347,22 @@ func (d *FileSystem) getDriveItem(ctx context.Context, name string) (*DriveItem,
 		return nil, err
 	}
 
+	epoch := d.epoch.Load()
 	cachedItem := d.itemCache.Get(name)
 	if cachedItem != nil {
 		item = cachedItem.Value()
+	} else if isTrashPath(name) {
+		item, err = d.walkTo(ctx, epoch, name, trashPath, d.c.trashFolder())
+		if err != nil {
+			return nil, err
+		}
+	} else if isOfflinePath(name) {
+		item, err = d.walkTo(ctx, epoch, name, offlinePath, d.offlineFolder())
+		if err != nil {
+			return nil, err
+		}
 	} else {
-		item, err = d.walkTo(ctx, name, "", root)
+		item, err = d.walkTo(ctx, epoch, name, "", root)
 		if err != nil {
 			return nil, err
 		}
@@ -190,9 +371,171 @@ func (d *FileSystem) getDriveItem(ctx context.Context, name string) (*DriveItem,
 	return item, nil
 }
 
+type uploadSizeKey struct{}
+
+// withUploadSize announces the size of a file about to be written through
+// OpenFile, e.g. from the Content-Length of a PUT.
+func withUploadSize(ctx context.Context, size int64) context.Context {
+	return context.WithValue(ctx, uploadSizeKey{}, size)
+}
+
+func uploadSize(ctx context.Context) int64 {
+	size, ok := ctx.Value(uploadSizeKey{}).(int64)
+	if !ok {
+		return -1
+	}
+	return size
+}
+
+// prepareCreate resolves the folder a new file at name goes into, and the
+// existing file it replaces if any. Files cannot be modified in place, so
+// replacing requires O_TRUNC. The existing file is left alone until the new
+// one is complete, see finishUpload.
+func (d *FileSystem) prepareCreate(ctx context.Context, name string, flag int) (parent *DriveItem, existing *DriveItem, err error) {
+	parentName, _ := splitPath(name)
+	parent, err = d.getDriveItem(ctx, parentName)
+	if err != nil {
+		return nil, nil, err
+	}
+	if parent == nil || !parent.IsFolder() {
+		return nil, nil, os.ErrNotExist
+	}
+
+	existing, err = d.getDriveItem(ctx, name)
+	if err != nil {
+		return nil, nil, err
+	}
+	if existing != nil {
+		if flag&os.O_EXCL != 0 {
+			return nil, nil, os.ErrExist
+		}
+		if existing.IsFolder() {
+			return nil, nil, os.ErrInvalid
+		}
+		if flag&os.O_TRUNC == 0 || d.c.Config.Delete == DeleteDeny {
+			// replacing a file removes the old one
+			return nil, nil, os.ErrPermission
+		}
+	} else if flag&os.O_CREATE == 0 {
+		return nil, nil, os.ErrNotExist
+	}
+
+	return parent, existing, nil
+}
+
+// uploadName returns the name a file at name is uploaded under. Replacing
+// files are uploaded under a temporary name next to the file they replace.
+func uploadName(name string, existing *DriveItem) string {
+	_, base := splitPath(name)
+	if existing == nil {
+		return base
+	}
+	return fmt.Sprintf(".%s.upload-%x", base, time.Now().UnixNano())
+}
+
+// finishUpload puts the completed upload of a file at name in place of the
+// file it replaces, which is removed as the DeletePolicy says.
+func (d *FileSystem) finishUpload(ctx context.Context, name string, uploaded *DriveItem, existing *DriveItem) error {
+	defer d.locks.lock(name)()
+	defer func() {
+		d.invalidate(name, existing)
+		d.forgetList(uploaded.ParentID)
+	}()
+
+	if existing == nil {
+		return nil
+	}
+	var err error
+	switch d.c.Config.Delete {
+	case DeleteDeny:
+		err = os.ErrPermission
+		uploaded.Delete(ctx)
+	case DeletePermanent:
+		err = existing.Delete(ctx)
+	default:
+		err = existing.Trash(ctx)
+	}
+	d.invalidateTrash()
+	if err != nil {
+		return err
+	}
+	_, base := splitPath(name)
+	_, err = uploaded.Rename(ctx, base)
+	if err != nil {
+		return err
+	}
+	uploaded.Name = base
+	return nil
+}
+
+// createFile opens name for writing, see prepareCreate.
+func (d *FileSystem) createFile(ctx context.Context, name string, flag int) (*File, error) {
+	name = sanitizeName(name)
+
+	if name == "" || isTrashPath(name) {
+		return nil, os.ErrPermission
+	}
+	if isOfflinePath(name) {
+		return d.createOfflineFile(ctx, name)
+	}
+
+	unlock := d.locks.lock(name)
+	parent, existing, err := d.prepareCreate(ctx, name, flag)
+	unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	fctx, cancel := context.WithCancel(ctx)
+	upload, err := parent.Upload(fctx, uploadName(name, existing), uploadSize(ctx), "")
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	return &File{
+		ctx:      fctx,
+		cancel:   cancel,
+		fs:       d,
+		name:     name,
+		upload:   upload,
+		replaces: existing,
+		stat: &fileStat{
+			f: upload.File,
+		},
+	}, nil
+}
+
+// Upload uploads size bytes read from r to name, replacing an existing file.
+// If hash, the GCID of the content, is known, PikPak is asked to complete the
+// upload from the hash alone first, and r is only read if that fails.
+func (d *FileSystem) Upload(ctx context.Context, name string, r io.Reader, size int64, hash string) (UploadMode, error) {
+	name = sanitizeName(name)
+
+	if name == "" || isTrashPath(name) || isOfflinePath(name) {
+		return 0, os.ErrPermission
+	}
+
+	unlock := d.locks.lock(name)
+	parent, existing, err := d.prepareCreate(ctx, name, os.O_CREATE|os.O_TRUNC)
+	unlock()
+	if err != nil {
+		return 0, err
+	}
+
+	uploaded, mode, err := parent.UploadFrom(ctx, uploadName(name, existing), r, size, hash)
+	if err != nil {
+		return 0, err
+	}
+	return mode, d.finishUpload(ctx, name, uploaded, existing)
+}
+
 func (d *FileSystem) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
-	d.mu.Lock()
-	defer d.mu.Unlock()
+	// x/net/webdav also opens existing files for writing to patch their
+	// properties, only creating or truncating starts an upload
+	if flag&(os.O_CREATE|os.O_TRUNC) != 0 {
+		return d.createFile(ctx, name, flag)
+	}
 
 	item, err := d.getDriveItem(ctx, name)
 	if err != nil {
@@ -209,13 +552,12 @@ func (d *FileSystem) Open(name string) (http.File, error) {
 func (d *FileSystem) RemoveAll(ctx context.Context, name string) error {
 	name = sanitizeName(name)
 
-	if name == "" {
-		// don't allow deleting root
+	if name == "" || name == trashPath || name == offlinePath || name == offlineTasksPath {
+		// don't allow deleting root or virtual folders
 		return os.ErrPermission
 	}
 
-	d.mu.Lock()
-	defer d.mu.Unlock()
+	defer d.locks.lock(name)()
 
 	item, err := d.getDriveItem(ctx, name)
 
@@ -227,31 +569,232 @@ func (d *FileSystem) RemoveAll(ctx context.Context, name string) error {
 		return os.ErrNotExist
 	}
 
-	var expiredKeys []string
-	keys := d.itemCache.Keys()
-	for _, key := range keys {
-		if strings.HasPrefix(key, name) {
-			expiredKeys = append(expiredKeys, key)
+	return d.remove(ctx, name, item)
+}
+
+// invalidate drops every cached entry for the item at name, everything below
+// it, and the listing of its parent.
+func (d *FileSystem) invalidate(name string, item *DriveItem) {
+	d.epoch.Add(1)
+	for _, key := range d.itemCache.Keys() {
+		if key == name || strings.HasPrefix(key, name+"/") {
+			d.itemCache.Delete(key)
 		}
 	}
-	for _, key := range expiredKeys {
-		d.itemCache.Delete(key)
-	}
 
-	d.listCache.Delete(item.ID)
-	d.fileCache.Delete(item.ID)
+	if item != nil {
+		d.forgetList(item.ID)
+		d.forgetList(item.ParentID)
+		d.fileCache.Delete(item.ID)
+	}
+}
 
-	return item.Trash(ctx)
+// forgetList drops the cached listing of the folder with the given ID.
+func (d *FileSystem) forgetList(id string) {
+	d.epoch.Add(1)
+	d.listCache.Delete(id)
 }
 
 func (d *FileSystem) Rename(ctx context.Context, oldname, newname string) error {
-	return os.ErrPermission
+	oldname = sanitizeName(oldname)
+	newname = sanitizeName(newname)
+
+	if oldname == "" || newname == "" || oldname == trashPath || isTrashPath(newname) ||
+		isOfflinePath(oldname) || isOfflinePath(newname) {
+		// don't allow moving root or virtual folders, or moving into them
+		return os.ErrPermission
+	}
+	if oldname == newname {
+		return nil
+	}
+	if strings.HasPrefix(newname, oldname+"/") {
+		// don't allow moving a folder into itself
+		return os.ErrInvalid
+	}
+
+	defer d.locks.lock(oldname, newname)()
+
+	item, err := d.getDriveItem(ctx, oldname)
+	if err != nil {
+		return err
+	}
+	if item == nil {
+		return os.ErrNotExist
+	}
+
+	parentName, base := splitPath(newname)
+	parent, err := d.getDriveItem(ctx, parentName)
+	if err != nil {
+		return err
+	}
+	if parent == nil || !parent.IsFolder() {
+		return os.ErrNotExist
+	}
+
+	existing, err := d.getDriveItem(ctx, newname)
+	if err != nil {
+		return err
+	}
+	if existing != nil {
+		// like os.Rename, replace the destination. x/net/webdav has already
+		// checked the Overwrite header at this point.
+		err = d.remove(ctx, newname, existing)
+		if err != nil {
+			return err
+		}
+	}
+
+	if isTrashPath(oldname) {
+		// moving out of the trash restores the item to its original folder
+		// first, it is moved on from there below
+		err = d.untrash(ctx, oldname, item)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = moveItem(ctx, item, parent, base)
+	d.invalidate(oldname, item)
+	d.invalidate(newname, nil)
+	d.forgetList(parent.ID)
+	return err
 }
 
-func (d *FileSystem) Stat(ctx context.Context, name string) (os.FileInfo, error) {
-	d.mu.RLock()
-	defer d.mu.RUnlock()
+// moveItem moves item into parent under the name base.
+func moveItem(ctx context.Context, item *DriveItem, parent *DriveItem, base string) error {
+	if item.ParentID != parent.ID {
+		err := item.Move(ctx, parent)
+		if err != nil {
+			return err
+		}
+	}
+
+	if item.Name != base {
+		_, err := item.Rename(ctx, base)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+var (
+	copyPollInterval = 500 * time.Millisecond
+	copyPollAttempts = 10
+)
+
+// Copy copies oldname to newname on the server side. If recursive is false
+// and oldname is a folder, only an empty folder is created at newname.
+func (d *FileSystem) Copy(ctx context.Context, oldname, newname string, recursive bool) error {
+	oldname = sanitizeName(oldname)
+	newname = sanitizeName(newname)
 
+	if newname == "" {
+		return os.ErrExist
+	}
+	if isTrashPath(oldname) || isTrashPath(newname) || isOfflinePath(oldname) || isOfflinePath(newname) {
+		return os.ErrPermission
+	}
+	if oldname == newname || strings.HasPrefix(newname, oldname+"/") {
+		// don't allow copying a folder into itself
+		return os.ErrInvalid
+	}
+
+	defer d.locks.lock(newname)()
+
+	item, err := d.getDriveItem(ctx, oldname)
+	if err != nil {
+		return err
+	}
+	if item == nil {
+		return os.ErrNotExist
+	}
+
+	parentName, base := splitPath(newname)
+	parent, err := d.getDriveItem(ctx, parentName)
+	if err != nil {
+		return err
+	}
+	if parent == nil || !parent.IsFolder() {
+		return os.ErrNotExist
+	}
+
+	existing, err := d.getDriveItem(ctx, newname)
+	if err != nil {
+		return err
+	}
+	if existing != nil {
+		return os.ErrExist
+	}
+
+	if item.IsFolder() && !recursive {
+		created, err := parent.CreateFolder(ctx, base)
+		if err != nil {
+			return err
+		}
+		d.cacheChild(parent, newname, created)
+		return nil
+	}
+
+	defer func() {
+		d.invalidate(newname, nil)
+		d.forgetList(parent.ID)
+	}()
+
+	if item.Name == base {
+		return item.Copy(ctx, parent)
+	}
+
+	// batchCopy keeps the original name. Copy into a temporary folder of
+	// its own, where nothing but the copy can appear, and rename and move it
+	// from there.
+	tmp, err := parent.CreateFolder(ctx, fmt.Sprintf(".%s.copy-%x", base, time.Now().UnixNano()))
+	if err != nil {
+		return err
+	}
+	defer func() {
+		// also drops the copy if it did not make it out in time
+		cctx, cancel := context.WithTimeout(detachedContext{ctx}, sharedCallTimeout)
+		defer cancel()
+		if err := tmp.Delete(cctx); err != nil {
+			log.Warn().Err(err).Str("id", tmp.ID).Msg("failed to delete temporary copy folder")
+		}
+	}()
+	err = item.Copy(ctx, tmp)
+	if err != nil {
+		return err
+	}
+	copied, err := findCopy(ctx, tmp)
+	if err != nil {
+		return err
+	}
+	return moveItem(ctx, copied, parent, base)
+}
+
+// findCopy waits for the copy made into the otherwise empty folder tmp to
+// appear. Copies may complete asynchronously, so tmp is polled for a while.
+func findCopy(ctx context.Context, tmp *DriveItem) (*DriveItem, error) {
+	for i := 0; i < copyPollAttempts; i++ {
+		list, err := tmp.List(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if len(list.Files) > 0 {
+			return list.Files[0], nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(copyPollInterval):
+		}
+	}
+
+	return nil, fmt.Errorf("copy did not appear in folder %s", tmp.ID)
+}
+
+func (d *FileSystem) Stat(ctx context.Context, name string) (os.FileInfo, error) {
 	item, err := d.getDriveItem(ctx, name)
 	if err != nil {
 		return nil, err
@@ -263,6 +806,12 @@ func (d *FileSystem) Stat(ctx context.Context, name string) (os.FileInfo, error)
 	return &fileStat{f: item}, nil
 }
 
+// uploader receives the content written to a File.
+type uploader interface {
+	io.WriteCloser
+	Written() int64
+}
+
 type File struct {
 	fs     *FileSystem
 	ctx    context.Context
@@ -270,8 +819,17 @@ type File struct {
 
 	rc io.ReadCloser
 
+	name   string
+	upload uploader
+	// replaces is the existing file the upload replaces once complete
+	replaces *DriveItem
+
 	fPos int64
-	dPos int
+
+	listed bool
+	it     *DriveFileIterator
+	page   []*DriveItem
+	dPos   int
 
 	mu   sync.Mutex
 	stat *fileStat
@@ -285,18 +843,48 @@ func (f *File) Readdir(count int) (fs []os.FileInfo, err error) {
 		return nil, os.ErrInvalid
 	}
 
-	dir, err := f.fs.cachedList(f.ctx, f.stat.f)
-	if err != nil {
-		return nil, err
+	if !f.listed {
+		f.listed = true
+		// stream large folders page by page unless the whole listing is
+		// wanted anyway or already cached
+		if count <= 0 || f.stat.f.virtual || f.fs.listCache.Get(f.stat.f.ID) != nil {
+			dir, err := f.fs.cachedList(f.ctx, f.stat.f)
+			if err != nil {
+				f.listed = false
+				return nil, err
+			}
+			f.page = dir.Files
+		} else {
+			f.it, err = f.stat.f.Iterate()
+			if err != nil {
+				return nil, err
+			}
+		}
 	}
 
-	if count <= 0 || count > len(dir.Files)-f.dPos {
-		count = len(dir.Files) - f.dPos
+	for count <= 0 || len(fs) < count {
+		if f.dPos >= len(f.page) {
+			if f.it == nil {
+				break
+			}
+			page, err := f.it.Next(f.ctx)
+			if err == io.EOF {
+				f.it = nil
+				break
+			}
+			if err != nil {
+				return fs, err
+			}
+			f.page = page.Files
+			f.dPos = 0
+			continue
+		}
+		fs = append(fs, &fileStat{f: f.page[f.dPos]})
+		f.dPos++
 	}
 
-	for i := 0; i < count; i++ {
-		fs = append(fs, &fileStat{f: dir.Files[f.dPos]})
-		f.dPos++
+	if count > 0 && len(fs) == 0 {
+		return nil, io.EOF
 	}
 
 	return fs, nil
@@ -313,37 +901,37 @@ func (f *File) Read(b []byte) (n int, err error) {
 	if f.stat.IsDir() {
 		return 0, os.ErrInvalid
 	}
+	if f.upload != nil {
+		return 0, os.ErrPermission
+	}
 
 	size := f.stat.Size()
+	if f.stat.f.virtual {
+		if f.fPos >= size {
+			return 0, io.EOF
+		}
+		n = copy(b, f.stat.f.content[f.fPos:])
+		f.fPos += int64(n)
+		return n, nil
+	}
+
 	if f.fPos >= size {
-		f.rc.Close()
-		f.rc = nil
+		// nothing was opened for empty files, or after seeking to the end
+		if f.rc != nil {
+			f.rc.Close()
+			f.rc = nil
+		}
 		return 0, io.EOF
 	}
 
 	if f.rc == nil {
-		file, err := f.fs.cachedFetch(f.ctx, f.stat.f)
-		if err != nil {
-			return 0, err
-		}
-
-		req, err := http.NewRequestWithContext(f.ctx, http.MethodGet, file.WebContentLink, nil)
+		f.rc, err = f.fs.openRange(f.ctx, f.stat.f, f.fPos, size-1, 1)
 		if err != nil {
 			return 0, err
 		}
-		req.Header = map[string][]string{
-			"Range": {"bytes=" + fmt.Sprint(f.fPos) + "-" + fmt.Sprint(size-1)},
+		if f.fPos == 0 {
+			f.rc = verifyDownload(f.rc, f.stat.f, f.fs.c.Config.VerifyDownloads)
 		}
-		resp, err := f.fs.c.http.Do(req)
-		if err != nil {
-			return 0, err
-		}
-
-		if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
-			return 0, fmt.Errorf("unexpected status code %d", resp.StatusCode)
-		}
-
-		f.rc = resp.Body
 	}
 
 	n, err = io.ReadFull(f.rc, b)
@@ -403,6 +991,20 @@ func (f *File) Close() error {
 		defer f.cancel()
 	}
 
+	if f.upload != nil {
+		err := f.upload.Close()
+		if err == nil {
+			err = f.fs.finishUpload(f.ctx, f.name, f.stat.f, f.replaces)
+		} else {
+			f.fs.invalidate(f.name, nil)
+			f.fs.forgetList(f.stat.f.ParentID)
+		}
+		if err != nil {
+			reportError(f.ctx, err)
+		}
+		return err
+	}
+
 	if f.rc != nil {
 		return f.rc.Close()
 	}
@@ -411,14 +1013,35 @@ func (f *File) Close() error {
 }
 
 func (f *File) Write(b []byte) (n int, err error) {
-	return 0, os.ErrPermission
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.upload == nil {
+		return 0, os.ErrPermission
+	}
+
+	n, err = f.upload.Write(b)
+	f.stat.f.Size = strconv.FormatInt(f.upload.Written(), 10)
+	if err != nil {
+		reportError(f.ctx, err)
+	}
+	return n, err
 }
 
 func (c *DriveClient) FileSystem() (*FileSystem, error) {
-	return &FileSystem{
-		c:         c,
-		itemCache: ttlcache.New[string, *DriveItem](),
-		listCache: ttlcache.New[string, *DriveFileList](),
-		fileCache: ttlcache.New[string, *DriveFile](),
-	}, nil
+	d := &FileSystem{
+		c:          c,
+		itemCache:  ttlcache.New[string, *DriveItem](),
+		listCache:  ttlcache.New[string, *DriveFileList](),
+		fileCache:  ttlcache.New[string, *DriveFile](),
+		aboutCache: ttlcache.New[string, *DriveAbout](),
+	}
+	if dir := c.Config.Cache.Dir; dir != "" {
+		var err error
+		d.blocks, err = openBlockCache(dir, c.Config.Cache.Size)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return d, nil
 }
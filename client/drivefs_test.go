@@ -0,0 +1,372 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSharedRunsOnce(t *testing.T) {
+	var fs FileSystem
+	var calls atomic.Int32
+	release := make(chan struct{})
+
+	var wg sync.WaitGroup
+	results := make([]string, 20)
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			v, err := shared(context.Background(), &fs.lists, "key", func(ctx context.Context) (string, error) {
+				calls.Add(1)
+				<-release
+				return "value", nil
+			})
+			if err != nil {
+				t.Error(err)
+			}
+			results[i] = v
+		}(i)
+	}
+	// let the callers pile up on the first call
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if n := calls.Load(); n != 1 {
+		t.Errorf("fn called %d times, want 1", n)
+	}
+	for i, v := range results {
+		if v != "value" {
+			t.Errorf("caller %d got %q", i, v)
+		}
+	}
+}
+
+func TestSharedCallerGivesUp(t *testing.T) {
+	var fs FileSystem
+	release := make(chan struct{})
+	fn := func(ctx context.Context) (string, error) {
+		select {
+		case <-release:
+			return "value", nil
+		case <-ctx.Done():
+			return "", ctx.Err()
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		_, err := shared(ctx, &fs.lists, "key", fn)
+		done <- err
+	}()
+	result := make(chan string)
+	go func() {
+		// give the first caller time to start the call
+		time.Sleep(50 * time.Millisecond)
+		v, err := shared(context.Background(), &fs.lists, "key", fn)
+		if err != nil {
+			t.Error(err)
+		}
+		result <- v
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Errorf("canceled caller got %v", err)
+	}
+	close(release)
+	if v := <-result; v != "value" {
+		t.Errorf("other caller got %q", v)
+	}
+}
+
+// fakeDrive is an in-memory stand-in for the parts of the drive API the
+// FileSystem uses to look up, trash and move items.
+type fakeDrive struct {
+	mu    sync.Mutex
+	items map[string]*DriveItem
+	ids   int
+	// onCopy is called with the lock held after batchCopy made a copy
+	onCopy func(copied *DriveItem)
+	// fetch returns the download links of the file with the given ID
+	fetch func(id string) *DriveFile
+}
+
+func (f *fakeDrive) newID() string {
+	f.ids++
+	return fmt.Sprintf("new%d", f.ids)
+}
+
+// deleteTree removes the item with the given ID and everything below it.
+func (f *fakeDrive) deleteTree(id string) {
+	delete(f.items, id)
+	for childID, item := range f.items {
+		if item.ParentID == id {
+			f.deleteTree(childID)
+		}
+	}
+}
+
+func (f *fakeDrive) add(id, parentID, name string, folder bool) {
+	kind := "drive#file"
+	if folder {
+		kind = "drive#folder"
+	}
+	f.items[id] = &DriveItem{Kind: kind, ID: id, ParentID: parentID, Name: name}
+}
+
+func (f *fakeDrive) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var req struct {
+		batchRequest
+		createFileRequest
+	}
+	if r.Body != nil {
+		json.NewDecoder(r.Body).Decode(&req)
+	}
+
+	switch {
+	case r.Method == "GET" && r.URL.Path == "/drive/v1/files":
+		parentID := r.URL.Query().Get("parent_id")
+		trashed := strings.Contains(r.URL.Query().Get("filters"), `"trashed":{"eq":true}`)
+		list := DriveFileList{Files: []*DriveItem{}}
+		for _, item := range f.items {
+			if item.trashed == trashed && (trashed || item.ParentID == parentID) {
+				copied := *item
+				list.Files = append(list.Files, &copied)
+			}
+		}
+		json.NewEncoder(w).Encode(list)
+	case r.Method == "POST" && r.URL.Path == "/drive/v1/files:batchTrash":
+		for _, id := range req.IDs {
+			if item := f.items[id]; item != nil {
+				item.trashed = true
+			}
+		}
+		w.Write([]byte("{}"))
+	case r.Method == "POST" && r.URL.Path == "/drive/v1/files:batchMove":
+		for _, id := range req.IDs {
+			if item := f.items[id]; item != nil {
+				item.ParentID = req.To.ParentID
+			}
+		}
+		w.Write([]byte("{}"))
+	case r.Method == "POST" && r.URL.Path == "/drive/v1/files:batchDelete":
+		for _, id := range req.IDs {
+			f.deleteTree(id)
+		}
+		w.Write([]byte("{}"))
+	case r.Method == "POST" && r.URL.Path == "/drive/v1/files:batchCopy":
+		for _, id := range req.IDs {
+			if item := f.items[id]; item != nil {
+				copied := *item
+				copied.ID = f.newID()
+				copied.ParentID = req.To.ParentID
+				f.items[copied.ID] = &copied
+				if f.onCopy != nil {
+					f.onCopy(&copied)
+				}
+			}
+		}
+		w.Write([]byte("{}"))
+	case r.Method == "POST" && r.URL.Path == "/drive/v1/files":
+		id := f.newID()
+		f.add(id, req.ParentID, req.Name, true)
+		json.NewEncoder(w).Encode(createFileResponse{File: f.items[id]})
+	case r.Method == "GET" && strings.HasPrefix(r.URL.Path, "/drive/v1/files/") && f.fetch != nil:
+		json.NewEncoder(w).Encode(f.fetch(strings.TrimPrefix(r.URL.Path, "/drive/v1/files/")))
+	case r.Method == "PATCH" && strings.HasPrefix(r.URL.Path, "/drive/v1/files/"):
+		item := f.items[strings.TrimPrefix(r.URL.Path, "/drive/v1/files/")]
+		if item == nil {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"error":"file_not_found"}`))
+			return
+		}
+		item.Name = req.Name
+		json.NewEncoder(w).Encode(item)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// rewriteTransport sends drive API requests to a test server.
+type rewriteTransport struct {
+	target *url.URL
+}
+
+func (t *rewriteTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.URL.Scheme = t.target.Scheme
+	req.URL.Host = t.target.Host
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+// newTestFileSystem returns a FileSystem talking to a fake drive API.
+func newTestFileSystem(t *testing.T, drive *fakeDrive) *FileSystem {
+	srv := httptest.NewServer(drive)
+	t.Cleanup(srv.Close)
+	target, _ := url.Parse(srv.URL)
+
+	c := &DriveClient{Client: &Client{}}
+	c.initOnce.Do(func() {})
+	c.http = &http.Client{Transport: &rewriteTransport{target: target}}
+	fs, err := c.FileSystem()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fs
+}
+
+func TestFileSystemConcurrentChanges(t *testing.T) {
+	const n = 20
+	drive := &fakeDrive{items: map[string]*DriveItem{}}
+	drive.add("a", "", "a", true)
+	drive.add("b", "", "b", true)
+	for i := 0; i < n; i++ {
+		drive.add(fmt.Sprintf("f%d", i), "a", fmt.Sprintf("f%d", i), false)
+	}
+	fs := newTestFileSystem(t, drive)
+	ctx := context.Background()
+
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			var err error
+			if i%2 == 0 {
+				err = fs.RemoveAll(ctx, fmt.Sprintf("/a/f%d", i))
+			} else {
+				err = fs.Rename(ctx, fmt.Sprintf("/a/f%d", i), fmt.Sprintf("/b/g%d", i))
+			}
+			if err != nil {
+				t.Error(err)
+			}
+		}(i)
+		go func(i int) {
+			defer wg.Done()
+			for _, name := range []string{"/a", "/b", fmt.Sprintf("/a/f%d", (i+1)%n), fmt.Sprintf("/b/g%d", i)} {
+				_, err := fs.getDriveItem(ctx, name)
+				if err != nil {
+					t.Error(err)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	// whatever the readers cached in between, the changes must show
+	for i := 0; i < n; i++ {
+		item, err := fs.getDriveItem(ctx, fmt.Sprintf("/a/f%d", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if item != nil {
+			t.Errorf("/a/f%d still exists", i)
+		}
+		item, err = fs.getDriveItem(ctx, fmt.Sprintf("/b/g%d", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if moved := i%2 == 1; moved != (item != nil) {
+			t.Errorf("/b/g%d exists: %v, want %v", i, item != nil, moved)
+		}
+	}
+	trash, err := fs.getDriveItem(ctx, "/.trash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	list, err := fs.cachedList(ctx, trash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Files) != n/2 {
+		t.Errorf("%d items in the trash, want %d", len(list.Files), n/2)
+	}
+}
+
+func TestFileSystemCopyRenames(t *testing.T) {
+	drive := &fakeDrive{items: map[string]*DriveItem{}}
+	drive.add("a", "", "a", true)
+	drive.add("b", "", "b", true)
+	drive.add("f", "a", "f", false)
+	drive.onCopy = func(copied *DriveItem) {
+		// something else shows up in the destination at the same time
+		drive.add("other", "b", "other", false)
+	}
+	fs := newTestFileSystem(t, drive)
+	ctx := context.Background()
+
+	err := fs.Copy(ctx, "/a/f", "/b/g", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	names := map[string]string{}
+	for id, item := range drive.items {
+		if item.ParentID == "b" {
+			names[item.Name] = id
+		}
+	}
+	if len(names) != 2 || names["g"] == "" || names["other"] != "other" {
+		t.Errorf("destination holds %v, want the copy as g and other untouched", names)
+	}
+	if _, ok := drive.items["f"]; !ok || drive.items["f"].ParentID != "a" || drive.items["f"].Name != "f" {
+		t.Error("source changed")
+	}
+	if len(drive.items) != 5 {
+		t.Errorf("%d items left, want 5 without the temporary folder", len(drive.items))
+	}
+}
+
+func TestFileSystemCopyTimeout(t *testing.T) {
+	interval, attempts := copyPollInterval, copyPollAttempts
+	copyPollInterval, copyPollAttempts = time.Millisecond, 2
+	defer func() { copyPollInterval, copyPollAttempts = interval, attempts }()
+
+	drive := &fakeDrive{items: map[string]*DriveItem{}}
+	drive.add("a", "", "a", true)
+	drive.add("f", "a", "f", false)
+	drive.onCopy = func(copied *DriveItem) {
+		// the copy is still running when Copy gives up
+		copied.trashed = true
+	}
+	fs := newTestFileSystem(t, drive)
+
+	err := fs.Copy(context.Background(), "/a/f", "/a/g", true)
+	if err == nil {
+		t.Fatal("copy succeeded")
+	}
+	if len(drive.items) != 2 {
+		t.Errorf("%d items left, want the source and its folder only", len(drive.items))
+	}
+}
+
+func TestFileReadEmpty(t *testing.T) {
+	fs := newTestFileSystem(t, &fakeDrive{items: map[string]*DriveItem{}})
+	f, err := fs.driveItemToFile(context.Background(), &DriveItem{Kind: "drive#file", ID: "empty", Size: "0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	n, err := f.Read(make([]byte, 512))
+	if n != 0 || err != io.EOF {
+		t.Errorf("Read = %d, %v, want 0, EOF", n, err)
+	}
+}
@@ -0,0 +1,146 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// indexEntry is an item in a directory index.
+type indexEntry struct {
+	Name         string    `json:"name"`
+	Path         string    `json:"path"`
+	Folder       bool      `json:"folder"`
+	Size         int64     `json:"size"`
+	MimeType     string    `json:"mimeType,omitempty"`
+	ModifiedTime time.Time `json:"modifiedTime"`
+	Hash         string    `json:"hash,omitempty"`
+}
+
+type indexCrumb struct {
+	Name string
+	Path string
+}
+
+var indexTemplate = template.Must(template.New("index").Funcs(template.FuncMap{
+	"size": formatSize,
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{.Path}}</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; }
+td, th { padding: 0.2em 1em 0.2em 0; text-align: left; }
+td.size { text-align: right; }
+a { text-decoration: none; }
+</style>
+</head>
+<body>
+<h1>{{range $i, $c := .Crumbs}}{{if $i}} / {{end}}<a href="{{$c.Path}}">{{$c.Name}}</a>{{end}}</h1>
+<table>
+<tr><th>Name</th><th>Size</th><th>Modified</th></tr>
+{{range .Entries}}<tr><td><a href="{{.Path}}">{{.Name}}{{if .Folder}}/{{end}}</a></td><td class="size">{{if not .Folder}}{{size .Size}}{{end}}</td><td>{{.ModifiedTime.Format "2006-01-02 15:04"}}</td></tr>
+{{end}}</table>
+</body>
+</html>
+`))
+
+// formatSize formats a byte count for humans.
+func formatSize(n int64) string {
+	if n < 1024 {
+		return fmt.Sprintf("%d B", n)
+	}
+	f := float64(n) / 1024
+	unit := 0
+	for f >= 1024 && unit < len(sizeUnits)-1 {
+		f /= 1024
+		unit++
+	}
+	return fmt.Sprintf("%.1f %ciB", f, sizeUnits[unit])
+}
+
+const sizeUnits = "KMGTPE"
+
+// serveIndex lists a folder, as JSON for clients that accept it and as an
+// HTML page otherwise.
+func (h *webdavHandler) serveIndex(w http.ResponseWriter, r *http.Request, item *DriveItem) {
+	name := sanitizeName(r.URL.Path)
+	if name != "" && !strings.HasSuffix(r.URL.Path, "/") {
+		// make relative links work
+		http.Redirect(w, r, (&url.URL{Path: name + "/"}).EscapedPath(), http.StatusMovedPermanently)
+		return
+	}
+
+	dir, err := h.fs.cachedList(r.Context(), item)
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+
+	entries := make([]indexEntry, 0, len(dir.Files))
+	for _, f := range dir.Files {
+		fi := &fileStat{f}
+		p := path.Join("/", name, f.Name)
+		if f.IsFolder() {
+			p += "/"
+		}
+		entries = append(entries, indexEntry{
+			Name:         f.Name,
+			Path:         (&url.URL{Path: p}).EscapedPath(),
+			Folder:       f.IsFolder(),
+			Size:         fi.Size(),
+			MimeType:     f.MimeType,
+			ModifiedTime: fi.ModTime(),
+			Hash:         f.Hash,
+		})
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		if entries[i].Folder != entries[j].Folder {
+			return entries[i].Folder
+		}
+		return entries[i].Name < entries[j].Name
+	})
+
+	if acceptsJSON(r) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(entries)
+		return
+	}
+
+	crumbs := []indexCrumb{{Name: "Home", Path: "/"}}
+	p := "/"
+	for _, part := range strings.Split(strings.Trim(name, "/"), "/") {
+		if part == "" {
+			continue
+		}
+		p = path.Join(p, part) + "/"
+		crumbs = append(crumbs, indexCrumb{Name: part, Path: (&url.URL{Path: p}).EscapedPath()})
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	indexTemplate.Execute(w, struct {
+		Path    string
+		Crumbs  []indexCrumb
+		Entries []indexEntry
+	}{path.Join("/", name), crumbs, entries})
+}
+
+// acceptsJSON tells whether the client asked for JSON rather than HTML.
+func acceptsJSON(r *http.Request) bool {
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		t, _, err := mime.ParseMediaType(strings.TrimSpace(accept))
+		if err == nil && t == "application/json" {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,57 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestServeIndexPaths(t *testing.T) {
+	drive := &fakeDrive{items: map[string]*DriveItem{}}
+	drive.add("sub", "", "sub", true)
+	drive.add("file", "", "a:b.mkv", false)
+	drive.add("inner", "sub", "Movies", true)
+	h := &webdavHandler{fs: newTestFileSystem(t, drive)}
+
+	tests := []struct {
+		dir   string
+		paths []string
+	}{
+		{"/", []string{"/sub/", "/a:b.mkv"}},
+		{"/sub/", []string{"/sub/Movies/"}},
+	}
+	for _, test := range tests {
+		item, err := h.fs.getDriveItem(context.Background(), test.dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		r := httptest.NewRequest("GET", test.dir, nil)
+		r.Header.Set("Accept", "application/json")
+		w := httptest.NewRecorder()
+		h.serveIndex(w, r, item)
+		var entries []indexEntry
+		err = json.Unmarshal(w.Body.Bytes(), &entries)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var paths []string
+		for _, e := range entries {
+			paths = append(paths, e.Path)
+		}
+		if strings.Join(paths, " ") != strings.Join(test.paths, " ") {
+			t.Errorf("index of %s links %v, want %v", test.dir, paths, test.paths)
+		}
+
+		r = httptest.NewRequest("GET", test.dir, nil)
+		w = httptest.NewRecorder()
+		h.serveIndex(w, r, item)
+		for _, p := range test.paths {
+			if !strings.Contains(w.Body.String(), `href="`+p+`"`) {
+				t.Errorf("HTML index of %s does not link %s", test.dir, p)
+			}
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package client
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/net/webdav"
+)
+
+// ifList is a list of an If header, its conditions all have to hold for the
+// tagged resource, or the request URL if there is no tag.
+type ifList struct {
+	tag        string
+	conditions []webdav.Condition
+}
+
+// parseIfHeader parses an If header as of RFC 4918, section 10.4, into its
+// lists, any one of which has to hold.
+func parseIfHeader(s string) ([]ifList, bool) {
+	var lists []ifList
+	tag := ""
+	for {
+		s = strings.TrimLeft(s, " \t")
+		if s == "" {
+			return lists, len(lists) > 0
+		}
+		switch s[0] {
+		case '<':
+			end := strings.IndexByte(s, '>')
+			if end < 0 {
+				return nil, false
+			}
+			tag, s = s[1:end], s[end+1:]
+		case '(':
+			l := ifList{tag: tag}
+			s = s[1:]
+			for {
+				s = strings.TrimLeft(s, " \t")
+				if strings.HasPrefix(s, ")") {
+					s = s[1:]
+					break
+				}
+				var c webdav.Condition
+				if strings.HasPrefix(s, "Not") {
+					c.Not = true
+					s = strings.TrimLeft(s[len("Not"):], " \t")
+				}
+				if s == "" || (s[0] != '<' && s[0] != '[') {
+					return nil, false
+				}
+				closing := byte('>')
+				if s[0] == '[' {
+					closing = ']'
+				}
+				end := strings.IndexByte(s, closing)
+				if end < 0 {
+					return nil, false
+				}
+				if closing == '>' {
+					c.Token = s[1:end]
+				} else {
+					c.ETag = s[1:end]
+				}
+				s = s[end+1:]
+				l.conditions = append(l.conditions, c)
+			}
+			if len(l.conditions) == 0 {
+				return nil, false
+			}
+			lists = append(lists, l)
+		default:
+			return nil, false
+		}
+	}
+}
+
+// confirmLocks makes sure the request may change dst, as x/net/webdav does
+// for the requests it handles itself. Without an If header, dst must not be
+// locked at all, otherwise the locks submitted must cover it. The returned
+// function releases the locks once the change is done.
+func (h *webdavHandler) confirmLocks(r *http.Request, dst string) (release func(), status int, err error) {
+	ls := h.h.LockSystem
+	now := time.Now()
+
+	hdr := r.Header.Get("If")
+	if hdr == "" {
+		// hold a temporary lock, so that no one locks dst in the meantime
+		token, err := ls.Create(now, webdav.LockDetails{
+			Root:      dst,
+			Duration:  -1,
+			ZeroDepth: true,
+		})
+		if err == webdav.ErrLocked {
+			return nil, http.StatusLocked, err
+		}
+		if err != nil {
+			return nil, http.StatusInternalServerError, err
+		}
+		return func() { ls.Unlock(now, token) }, 0, nil
+	}
+
+	lists, ok := parseIfHeader(hdr)
+	if !ok {
+		return nil, http.StatusBadRequest, errors.New("invalid If header")
+	}
+	for _, l := range lists {
+		// a tagged list has to hold for the tagged resource as well
+		src := ""
+		if l.tag != "" {
+			u, err := url.Parse(l.tag)
+			if err != nil || u.Host != r.Host {
+				continue
+			}
+			src = u.Path
+		}
+		release, err := ls.Confirm(now, src, dst, l.conditions...)
+		if err == webdav.ErrConfirmationFailed {
+			continue
+		}
+		if err != nil {
+			return nil, http.StatusInternalServerError, err
+		}
+		return release, 0, nil
+	}
+	return nil, http.StatusLocked, webdav.ErrLocked
+}
@@ -0,0 +1,78 @@
+package client
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"golang.org/x/net/webdav"
+)
+
+func TestParseIfHeader(t *testing.T) {
+	tests := []struct {
+		header string
+		lists  []ifList
+		ok     bool
+	}{
+		{"(<urn:a>)", []ifList{{conditions: []webdav.Condition{{Token: "urn:a"}}}}, true},
+		{`(<urn:a> ["etag"]) (Not <urn:b>)`, []ifList{
+			{conditions: []webdav.Condition{{Token: "urn:a"}, {ETag: `"etag"`}}},
+			{conditions: []webdav.Condition{{Not: true, Token: "urn:b"}}},
+		}, true},
+		{"<http://host/a> (<urn:a>) <http://host/b> (<urn:b>)", []ifList{
+			{tag: "http://host/a", conditions: []webdav.Condition{{Token: "urn:a"}}},
+			{tag: "http://host/b", conditions: []webdav.Condition{{Token: "urn:b"}}},
+		}, true},
+		{"", nil, false},
+		{"()", nil, false},
+		{"(<urn:a>", nil, false},
+		{"(urn:a)", nil, false},
+		{"<http://host/a>", nil, false},
+	}
+	for _, test := range tests {
+		lists, ok := parseIfHeader(test.header)
+		if ok != test.ok || !reflect.DeepEqual(lists, test.lists) {
+			t.Errorf("parseIfHeader(%q) = %v, %v, want %v, %v", test.header, lists, ok, test.lists, test.ok)
+		}
+	}
+}
+
+func TestConfirmLocks(t *testing.T) {
+	ls := webdav.NewMemLS()
+	h := &webdavHandler{h: &webdav.Handler{LockSystem: ls}}
+	token, err := ls.Create(time.Now(), webdav.LockDetails{Root: "/dst", Duration: -1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		header string
+		status int
+	}{
+		{"/dst", "", http.StatusLocked},
+		{"/dst/child", "", http.StatusLocked},
+		{"/other", "", 0},
+		{"/dst", "(<" + token + ">)", 0},
+		{"/dst", "(<urn:other>)", http.StatusLocked},
+		{"/dst", "(<urn:other>) (<" + token + ">)", 0},
+		{"/dst", "<http://example.com/dst> (<" + token + ">)", 0},
+		{"/dst", "<http://elsewhere/dst> (<" + token + ">)", http.StatusLocked},
+		{"/dst", "(", http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("COPY", "http://example.com/src", nil)
+		if test.header != "" {
+			r.Header.Set("If", test.header)
+		}
+		release, status, _ := h.confirmLocks(r, test.name)
+		if status != test.status {
+			t.Errorf("confirmLocks(%s, If: %q) status %d, want %d", test.name, test.header, status, test.status)
+		}
+		if release != nil {
+			release()
+		}
+	}
+}
@@ -0,0 +1,263 @@
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// offlinePath is the virtual folder offline downloads are created from.
+// Writing a file containing magnet or HTTP links, or a .torrent file, into it
+// starts a cloud download for each link. The status of every download is
+// shown as a JSON file in offlineTasksPath, deleting it cancels the download.
+const (
+	offlinePath      = "/.offline"
+	offlineTasksPath = offlinePath + "/tasks"
+)
+
+const (
+	offlineFolderID      = "pikpakdav#offline"
+	offlineTasksFolderID = "pikpakdav#offline-tasks"
+	offlineTaskIDPrefix  = "pikpakdav#offline-task-"
+	maxOfflineFileSize   = 32 << 20
+)
+
+var (
+	offlineLinkPrefixes = []string{"magnet:", "http://", "https://", "ftp://", "ed2k://"}
+
+	errOfflineFileTooLarge = errors.New("offline download file too large")
+	errOfflineNoLinks      = errors.New("no links found in offline download file")
+
+	offlineTasksCacheTime = 5 * time.Second
+)
+
+func isOfflinePath(name string) bool {
+	return name == offlinePath || strings.HasPrefix(name, offlinePath+"/")
+}
+
+func (d *FileSystem) offlineFolder() *DriveItem {
+	return &DriveItem{
+		c:       d.c,
+		virtual: true,
+		Kind:    "drive#folder",
+		ID:      offlineFolderID,
+		Name:    ".offline",
+	}
+}
+
+func (d *FileSystem) offlineTasksFolder() *DriveItem {
+	return &DriveItem{
+		c:        d.c,
+		virtual:  true,
+		Kind:     "drive#folder",
+		ID:       offlineTasksFolderID,
+		ParentID: offlineFolderID,
+		Name:     path.Base(offlineTasksPath),
+	}
+}
+
+// offlineTaskFile presents an offline task as a read-only JSON file.
+func (d *FileSystem) offlineTaskFile(task *OfflineTask) (*DriveItem, error) {
+	content, err := json.MarshalIndent(task, "", "\t")
+	if err != nil {
+		return nil, err
+	}
+	name := task.ID + ".json"
+	if task.Name != "" {
+		name = strings.ReplaceAll(task.Name, "/", "_") + "." + name
+	}
+	return &DriveItem{
+		c:            d.c,
+		virtual:      true,
+		content:      content,
+		Kind:         "drive#file",
+		ID:           offlineTaskIDPrefix + task.ID,
+		ParentID:     offlineTasksFolderID,
+		Name:         name,
+		Size:         strconv.Itoa(len(content)),
+		CreatedTime:  task.CreatedTime,
+		ModifiedTime: task.UpdatedTime,
+	}, nil
+}
+
+// offlineList lists the virtual offline folders. ok is false if item is not
+// one of them.
+func (d *FileSystem) offlineList(ctx context.Context, item *DriveItem) (list *DriveFileList, ok bool, err error) {
+	switch item.ID {
+	case offlineFolderID:
+		return &DriveFileList{
+			c:     d.c,
+			Files: []*DriveItem{d.offlineTasksFolder()},
+		}, true, nil
+	case offlineTasksFolderID:
+		cached := d.listCache.Get(offlineTasksFolderID)
+		if cached != nil {
+			return cached.Value(), true, nil
+		}
+		tasks, err := d.c.OfflineTasks(ctx)
+		if err != nil {
+			return nil, true, err
+		}
+		list = &DriveFileList{c: d.c}
+		for _, task := range tasks {
+			file, err := d.offlineTaskFile(task)
+			if err != nil {
+				return nil, true, err
+			}
+			list.Files = append(list.Files, file)
+		}
+		d.listCache.Set(offlineTasksFolderID, list, offlineTasksCacheTime)
+		return list, true, nil
+	}
+	return nil, false, nil
+}
+
+// cancelOfflineTask cancels the offline task shown as item.
+func (d *FileSystem) cancelOfflineTask(ctx context.Context, item *DriveItem) error {
+	if !strings.HasPrefix(item.ID, offlineTaskIDPrefix) {
+		return os.ErrPermission
+	}
+	err := d.c.CancelOfflineTask(ctx, strings.TrimPrefix(item.ID, offlineTaskIDPrefix))
+	d.forgetList(offlineTasksFolderID)
+	return err
+}
+
+// offlineLinks extracts the links to download from a file written into the
+// offline folder. Besides .torrent files, plain lists of links as well as
+// .magnet and .url (internet shortcut) files are understood.
+func offlineLinks(name string, data []byte) ([]string, error) {
+	if strings.HasSuffix(strings.ToLower(name), ".torrent") || bytes.HasPrefix(data, []byte("d")) {
+		magnet, err := torrentMagnet(data)
+		if err == nil {
+			return []string{magnet}, nil
+		}
+		if strings.HasSuffix(strings.ToLower(name), ".torrent") {
+			return nil, err
+		}
+	}
+
+	var links []string
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(nil, maxOfflineFileSize)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) > 4 && strings.EqualFold(line[:4], "URL=") {
+			line = strings.TrimSpace(line[4:])
+		}
+		for _, prefix := range offlineLinkPrefixes {
+			if len(line) > len(prefix) && strings.EqualFold(line[:len(prefix)], prefix) {
+				links = append(links, line)
+				break
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(links) == 0 {
+		return nil, errOfflineNoLinks
+	}
+	return links, nil
+}
+
+// offlineParent resolves the folder offline downloads are saved to, nil for
+// PikPak's default.
+func (d *FileSystem) offlineParent(ctx context.Context) (*DriveItem, error) {
+	folder := sanitizeName(d.c.Config.Offline.Folder)
+	if folder == "" {
+		return nil, nil
+	}
+	if !strings.HasPrefix(folder, "/") {
+		folder = "/" + folder
+	}
+	parent, err := d.getDriveItem(ctx, folder)
+	if err != nil {
+		return nil, err
+	}
+	if parent == nil || !parent.IsFolder() {
+		return nil, os.ErrNotExist
+	}
+	return parent, nil
+}
+
+// offlineSubmission collects a file written into the offline folder, and
+// starts the downloads it links to on Close.
+type offlineSubmission struct {
+	ctx  context.Context
+	fs   *FileSystem
+	name string
+	buf  bytes.Buffer
+	err  error
+}
+
+func (s *offlineSubmission) Write(b []byte) (int, error) {
+	if s.err != nil {
+		return 0, s.err
+	}
+	if s.buf.Len()+len(b) > maxOfflineFileSize {
+		s.err = errOfflineFileTooLarge
+		return 0, s.err
+	}
+	return s.buf.Write(b)
+}
+
+func (s *offlineSubmission) Written() int64 {
+	return int64(s.buf.Len())
+}
+
+func (s *offlineSubmission) Close() error {
+	if s.err != nil {
+		return s.err
+	}
+	links, err := offlineLinks(s.name, s.buf.Bytes())
+	if err != nil {
+		return err
+	}
+	parent, err := s.fs.offlineParent(s.ctx)
+	if err != nil {
+		return err
+	}
+	for _, link := range links {
+		_, err = s.fs.c.AddOfflineTask(s.ctx, parent, link)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *FileSystem) createOfflineFile(ctx context.Context, name string) (*File, error) {
+	parentName, base := splitPath(name)
+	if parentName != offlinePath || name == offlineTasksPath {
+		return nil, os.ErrPermission
+	}
+
+	fctx, cancel := context.WithCancel(ctx)
+	return &File{
+		ctx:    fctx,
+		cancel: cancel,
+		fs:     d,
+		name:   name,
+		upload: &offlineSubmission{
+			ctx:  fctx,
+			fs:   d,
+			name: base,
+		},
+		stat: &fileStat{
+			f: &DriveItem{
+				c:        d.c,
+				virtual:  true,
+				Kind:     "drive#file",
+				ParentID: offlineFolderID,
+				Name:     base,
+			},
+		},
+	}, nil
+}
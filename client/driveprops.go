@@ -0,0 +1,98 @@
+package client
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+	"golang.org/x/net/webdav"
+)
+
+// RFC 4331 quota properties, x/net/webdav has no live properties for them
+// so they are served as dead properties.
+var (
+	quotaAvailableBytesName = xml.Name{Space: "DAV:", Local: "quota-available-bytes"}
+	quotaUsedBytesName      = xml.Name{Space: "DAV:", Local: "quota-used-bytes"}
+)
+
+// pikpakNamespace holds the content hashes PikPak reports for files.
+const pikpakNamespace = "https://github.com/gyf304/pikpakdav/ns"
+
+var (
+	gcidName = xml.Name{Space: pikpakNamespace, Local: "gcid"}
+	md5Name  = xml.Name{Space: pikpakNamespace, Local: "md5"}
+	// ownCloud's checksums property, which e.g. rclone reads with
+	// --webdav-vendor owncloud
+	checksumsName = xml.Name{Space: "http://owncloud.org/ns", Local: "checksums"}
+)
+
+func property(name xml.Name, value string) webdav.Property {
+	var buf bytes.Buffer
+	xml.EscapeText(&buf, []byte(value))
+	return webdav.Property{XMLName: name, InnerXML: buf.Bytes()}
+}
+
+func (f *File) DeadProps() (map[xml.Name]webdav.Property, error) {
+	props := make(map[xml.Name]webdav.Property)
+
+	if f.stat.IsDir() {
+		about, err := f.fs.cachedAbout(f.ctx)
+		if err != nil {
+			// don't fail the whole PROPFIND over the quota
+			log.Warn().Err(err).Msg("failed to fetch quota")
+		} else {
+			used, _ := strconv.ParseInt(about.Quota.Usage, 10, 64)
+			limit, _ := strconv.ParseInt(about.Quota.Limit, 10, 64)
+			props[quotaUsedBytesName] = property(quotaUsedBytesName, strconv.FormatInt(used, 10))
+			if limit > 0 {
+				available := limit - used
+				if available < 0 {
+					available = 0
+				}
+				props[quotaAvailableBytesName] = property(quotaAvailableBytesName, strconv.FormatInt(available, 10))
+			}
+		}
+	}
+
+	if sum := f.stat.f.MD5Checksum; sum != "" {
+		props[md5Name] = property(md5Name, sum)
+		var buf bytes.Buffer
+		buf.WriteString(`<checksum xmlns="http://owncloud.org/ns">MD5:`)
+		xml.EscapeText(&buf, []byte(sum))
+		buf.WriteString(`</checksum>`)
+		props[checksumsName] = webdav.Property{XMLName: checksumsName, InnerXML: buf.Bytes()}
+	}
+	if hash := f.stat.f.Hash; hash != "" && !f.stat.IsDir() {
+		props[gcidName] = property(gcidName, hash)
+	}
+
+	return props, nil
+}
+
+// setChecksumHeaders advertises the MD5 of item in the formats sync tools
+// understand.
+func setChecksumHeaders(h http.Header, item *DriveItem) {
+	sum, err := hex.DecodeString(item.MD5Checksum)
+	if err != nil || len(sum) != md5.Size {
+		return
+	}
+	h.Set("OC-Checksum", "MD5:"+strings.ToLower(item.MD5Checksum))
+	h.Set("Digest", "md5="+base64.StdEncoding.EncodeToString(sum))
+}
+
+// Patch refuses every change, properties are not writable.
+func (f *File) Patch(patches []webdav.Proppatch) ([]webdav.Propstat, error) {
+	pstat := webdav.Propstat{Status: http.StatusForbidden}
+	for _, patch := range patches {
+		for _, p := range patch.Props {
+			pstat.Props = append(pstat.Props, webdav.Property{XMLName: p.XMLName})
+		}
+	}
+	return []webdav.Propstat{pstat}, nil
+}
@@ -0,0 +1,77 @@
+package client
+
+import (
+	"context"
+	"os"
+	"strings"
+)
+
+// trashPath is the virtual, read-only folder listing trashed items. Items
+// can be restored by moving them out of it, and deleted permanently by
+// deleting them inside it.
+const trashPath = "/.trash"
+
+func isTrashPath(name string) bool {
+	return name == trashPath || strings.HasPrefix(name, trashPath+"/")
+}
+
+// invalidateTrash drops the cached trash listing.
+func (d *FileSystem) invalidateTrash() {
+	d.invalidate(trashPath, nil)
+	d.forgetList(trashFolderID)
+}
+
+// trash moves the item at name to the trash.
+func (d *FileSystem) trash(ctx context.Context, name string, item *DriveItem) error {
+	err := item.Trash(ctx)
+	d.invalidate(name, item)
+	d.invalidateTrash()
+	return err
+}
+
+// untrash restores the trashed item at name to its original folder.
+func (d *FileSystem) untrash(ctx context.Context, name string, item *DriveItem) error {
+	err := item.Untrash(ctx)
+	d.invalidate(name, item)
+	d.invalidateTrash()
+	return err
+}
+
+// deletePermanently deletes the item at name, bypassing the trash.
+func (d *FileSystem) deletePermanently(ctx context.Context, name string, item *DriveItem) error {
+	err := item.Delete(ctx)
+	d.invalidate(name, item)
+	d.invalidateTrash()
+	return err
+}
+
+// remove deletes the item at name as the configured DeletePolicy says.
+// Items inside the trash can only be deleted permanently, deleting an offline
+// task cancels it.
+func (d *FileSystem) remove(ctx context.Context, name string, item *DriveItem) error {
+	if isOfflinePath(name) {
+		return d.cancelOfflineTask(ctx, item)
+	}
+
+	switch d.c.Config.Delete {
+	case DeleteDeny:
+		return os.ErrPermission
+	case DeletePermanent:
+		return d.deletePermanently(ctx, name, item)
+	}
+	if isTrashPath(name) {
+		return d.deletePermanently(ctx, name, item)
+	}
+	return d.trash(ctx, name, item)
+}
+
+// emptyTrash permanently deletes every trashed item, unless deleting is
+// denied.
+func (d *FileSystem) emptyTrash(ctx context.Context) error {
+	if d.c.Config.Delete == DeleteDeny {
+		return os.ErrPermission
+	}
+	err := d.c.EmptyTrash(ctx)
+	d.invalidateTrash()
+	return err
+}
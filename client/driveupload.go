@@ -0,0 +1,244 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	minUploadPartSize     = 8 << 20
+	unknownUploadPartSize = 16 << 20
+	maxUploadParts        = 10000
+)
+
+var (
+	errUploadClosed = errors.New("upload already closed")
+	errUploadNoData = errors.New("upload does not accept data")
+)
+
+// Upload is an upload of a new file. Data written to it is sent to object
+// storage in parts as soon as a part is full, so only a single part is held
+// in memory. Close completes the upload.
+type Upload struct {
+	File *DriveItem
+
+	ctx      context.Context
+	size     int64
+	oss      *ossMultipartUpload
+	partSize int
+	buf      []byte
+	written  int64
+	closed   bool
+	err      error
+}
+
+// uploadPartSize picks a part size that keeps a file of the given size within
+// the object storage part limit.
+func uploadPartSize(size int64) int {
+	if size < 0 {
+		return unknownUploadPartSize
+	}
+	partSize := minUploadPartSize
+	for size > int64(partSize)*int64(maxUploadParts) {
+		partSize *= 2
+	}
+	return partSize
+}
+
+// UploadMode tells how the content of an upload got to PikPak.
+type UploadMode int
+
+const (
+	// UploadModeResumable uploads transfer the content to object storage.
+	UploadModeResumable UploadMode = iota
+	// UploadModeFlash uploads complete from the hash alone, because PikPak
+	// already has the content.
+	UploadModeFlash
+)
+
+func (m UploadMode) String() string {
+	switch m {
+	case UploadModeResumable:
+		return "resumable"
+	case UploadModeFlash:
+		return "flash"
+	}
+	return "unknown"
+}
+
+// Upload creates a file named name in the folder and returns an Upload to
+// write its content to. size may be -1 if unknown. If hash, the GCID of the
+// content, is given along with the size, PikPak may complete the upload
+// right away, in which case no content must be written.
+func (f *DriveItem) Upload(ctx context.Context, name string, size int64, hash string) (*Upload, error) {
+	if !f.IsFolder() {
+		return nil, errors.New("not a folder")
+	}
+
+	req := &createFileRequest{
+		Kind:        "drive#file",
+		ParentID:    f.ID,
+		Name:        name,
+		UploadType:  "UPLOAD_TYPE_RESUMABLE",
+		ObjProvider: &objProvider{Provider: "UPLOAD_TYPE_UNKNOWN"},
+	}
+	if size >= 0 {
+		req.Size = strconv.FormatInt(size, 10)
+		req.Hash = strings.ToUpper(hash)
+	}
+
+	var resp createFileResponse
+	err := f.c.doJSON(ctx, "POST", filesURL, req, &resp)
+	if err != nil {
+		return nil, err
+	}
+	if resp.File == nil {
+		return nil, errors.New("no file in response")
+	}
+	resp.File.c = f.c
+
+	u := &Upload{
+		File: resp.File,
+		ctx:  ctx,
+		size: size,
+	}
+	if resp.Resumable != nil {
+		u.oss = &ossMultipartUpload{params: resp.Resumable.Params}
+		u.partSize = uploadPartSize(size)
+		err = u.oss.initiate(ctx)
+		if err != nil {
+			u.File.Trash(context.Background())
+			return nil, err
+		}
+	}
+	return u, nil
+}
+
+// UploadFrom uploads size bytes read from r into a new file named name. If
+// hash is given, an upload from the hash alone is tried first, and r is only
+// read if PikPak asks for the content.
+func (f *DriveItem) UploadFrom(ctx context.Context, name string, r io.Reader, size int64, hash string) (*DriveItem, UploadMode, error) {
+	u, err := f.Upload(ctx, name, size, hash)
+	if err != nil {
+		return nil, 0, err
+	}
+	if u.Mode() == UploadModeResumable {
+		_, err = io.Copy(u, io.LimitReader(r, size))
+		if err != nil && u.err == nil {
+			u.err = err
+		}
+	}
+	err = u.Close()
+	if err != nil {
+		return nil, 0, err
+	}
+	return u.File, u.Mode(), nil
+}
+
+// Mode returns how the content gets to PikPak. For UploadModeFlash, the
+// upload is already complete.
+func (u *Upload) Mode() UploadMode {
+	if u.oss == nil {
+		return UploadModeFlash
+	}
+	return UploadModeResumable
+}
+
+// Written returns the number of bytes written so far.
+func (u *Upload) Written() int64 {
+	return u.written
+}
+
+func (u *Upload) Write(b []byte) (int, error) {
+	if u.closed {
+		return 0, errUploadClosed
+	}
+	if u.err != nil {
+		return 0, u.err
+	}
+	if u.oss == nil {
+		if len(b) > 0 {
+			u.err = errUploadNoData
+		}
+		return 0, u.err
+	}
+
+	n := 0
+	for len(b) > 0 {
+		if u.buf == nil {
+			u.buf = make([]byte, 0, u.partSize)
+		}
+		m := copy(u.buf[len(u.buf):cap(u.buf)], b)
+		u.buf = u.buf[:len(u.buf)+m]
+		b = b[m:]
+		n += m
+		u.written += int64(m)
+
+		if len(u.buf) == cap(u.buf) {
+			err := u.oss.uploadPart(u.ctx, u.buf)
+			if err != nil {
+				u.err = err
+				return n, err
+			}
+			u.buf = u.buf[:0]
+		}
+	}
+	return n, nil
+}
+
+// Close uploads the remaining data and completes the upload. If a write
+// failed, the request was cancelled, or the size announced to Upload was not
+// reached, the upload is aborted and the file removed instead.
+func (u *Upload) Close() error {
+	if u.closed {
+		return errUploadClosed
+	}
+	u.closed = true
+
+	if u.oss == nil && u.err == nil {
+		// nothing to transfer
+		log.Debug().Str("name", u.File.Name).Stringer("mode", u.Mode()).Msg("upload completed")
+		return nil
+	}
+
+	if u.err == nil && u.size >= 0 && u.written != u.size {
+		u.err = fmt.Errorf("upload size mismatch: expected %d bytes, got %d", u.size, u.written)
+	}
+	if u.err == nil {
+		u.err = u.ctx.Err()
+	}
+	if u.err != nil {
+		u.abort()
+		return u.err
+	}
+
+	if len(u.buf) > 0 || len(u.oss.parts) == 0 {
+		u.err = u.oss.uploadPart(u.ctx, u.buf)
+	}
+	if u.err == nil {
+		u.err = u.oss.complete(u.ctx)
+	}
+	u.buf = nil
+	if u.err != nil {
+		u.abort()
+		return u.err
+	}
+	log.Debug().Str("name", u.File.Name).Stringer("mode", u.Mode()).Msg("upload completed")
+	return nil
+}
+
+func (u *Upload) abort() {
+	// the request context may already be done at this point
+	ctx := context.Background()
+	if u.oss != nil && u.oss.uploadID != "" {
+		u.oss.abort(ctx)
+	}
+	// the placeholder of the aborted upload is not worth keeping in the trash
+	u.File.Delete(ctx)
+}
@@ -1,10 +1,16 @@
 package client
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"io"
 	"net/http"
 	"net/url"
-	"time"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
 
 	"golang.org/x/net/webdav"
 	"golang.org/x/sync/semaphore"
@@ -14,77 +20,390 @@ var (
 	maxDownloadConnections = 2
 )
 
+const (
+	adminPrefix    = "/.admin/"
+	emptyTrashPath = adminPrefix + "empty-trash"
+	// adminHeader must be set on admin requests. Browsers only send custom
+	// headers cross-origin after a CORS preflight, which is never granted,
+	// so other sites cannot make a logged in browser call admin endpoints.
+	adminHeader = "X-Pikpakdav-Admin"
+)
+
 type webdavHandler struct {
 	h   *webdav.Handler
 	fs  *FileSystem
 	sem *semaphore.Weighted
+	// redirectUA limits redirects to matching clients if set
+	redirectUA *regexp.Regexp
+}
+
+// redirects tells whether r should be answered with a redirect to the
+// download link rather than proxied.
+func (h *webdavHandler) redirects(r *http.Request) bool {
+	if !h.fs.c.Config.Download.Redirect {
+		return false
+	}
+	return h.redirectUA == nil || h.redirectUA.MatchString(r.UserAgent())
 }
 
 func (h *webdavHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	if r.Method == "GET" {
+	if strings.HasPrefix(r.URL.Path, adminPrefix) {
+		h.serveAdmin(w, r)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
 		// directly serve the file, bypassing webdav
-		ctx := r.Context()
-		err := h.sem.Acquire(ctx, 1)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+		h.serveGet(w, r)
+	case "COPY":
+		// copy on the server side, x/net/webdav would copy the bytes through
+		// the FileSystem
+		h.serveCopy(w, r)
+	case "PUT":
+		// let the upload know the size up front
+		h.serveDAV(w, r.WithContext(withUploadSize(r.Context(), r.ContentLength)))
+	case "DELETE":
+		// x/net/webdav answers every failed DELETE with 405. Cancelling
+		// offline tasks is not deleting anything.
+		if h.fs.c.Config.Delete == DeleteDeny && !isOfflinePath(sanitizeName(r.URL.Path)) {
+			http.Error(w, "deleting is not allowed", http.StatusForbidden)
 			return
 		}
-		defer h.sem.Release(1)
+		h.serveDAV(w, r)
+	default:
+		h.serveDAV(w, r)
+	}
+}
 
-		item, err := h.fs.getDriveItem(ctx, r.URL.Path)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-		if item.IsFolder() {
-			http.Error(w, "not a file", http.StatusNotFound)
-			return
-		}
-		f, err := h.fs.cachedFetch(ctx, item)
+// serveDAV passes a request on to x/net/webdav, which answers most
+// FileSystem errors with a generic status. Errors of the PikPak API get the
+// status matching them instead.
+func (h *webdavHandler) serveDAV(w http.ResponseWriter, r *http.Request) {
+	slot := &errorSlot{}
+	ctx := context.WithValue(r.Context(), errorSlotKey{}, slot)
+	h.h.ServeHTTP(&statusWriter{ResponseWriter: w, slot: slot}, r.WithContext(ctx))
+}
+
+type errorSlotKey struct{}
+
+// errorSlot holds the outcome of the last FileSystem call of a request.
+type errorSlot struct {
+	err error
+}
+
+// reportError keeps err in the errorSlot of the request, if there is one.
+func reportError(ctx context.Context, err error) error {
+	if slot, ok := ctx.Value(errorSlotKey{}).(*errorSlot); ok {
+		slot.err = err
+	}
+	return err
+}
+
+// statusWriter replaces the error statuses x/net/webdav picks for failed
+// FileSystem calls with the one matching the API error behind them.
+type statusWriter struct {
+	http.ResponseWriter
+	slot      *errorSlot
+	rewritten bool
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	var apiErr *APIError
+	if code >= 300 && errors.As(w.slot.err, &apiErr) {
+		httpError(w.ResponseWriter, w.slot.err)
+		w.rewritten = true
+		return
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.rewritten {
+		// the body of the catch-all status
+		return len(b), nil
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// reportingFS reports the errors of FileSystem calls made by x/net/webdav.
+type reportingFS struct {
+	*FileSystem
+}
+
+func (fs reportingFS) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	return reportError(ctx, fs.FileSystem.Mkdir(ctx, name, perm))
+}
+
+func (fs reportingFS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	f, err := fs.FileSystem.OpenFile(ctx, name, flag, perm)
+	return f, reportError(ctx, err)
+}
+
+func (fs reportingFS) RemoveAll(ctx context.Context, name string) error {
+	return reportError(ctx, fs.FileSystem.RemoveAll(ctx, name))
+}
+
+func (fs reportingFS) Rename(ctx context.Context, oldName, newName string) error {
+	return reportError(ctx, fs.FileSystem.Rename(ctx, oldName, newName))
+}
+
+func (fs reportingFS) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	fi, err := fs.FileSystem.Stat(ctx, name)
+	return fi, reportError(ctx, err)
+}
+
+func (h *webdavHandler) serveGet(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	item, err := h.fs.getDriveItem(ctx, r.URL.Path)
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+	if item == nil {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	if item.IsFolder() {
+		h.serveIndex(w, r, item)
+		return
+	}
+	if item.virtual {
+		// virtual files are served from memory by x/net/webdav
+		h.serveDAV(w, r)
+		return
+	}
+	if h.redirects(r) {
+		file, err := h.fs.cachedFetch(ctx, item)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			httpError(w, err)
 			return
 		}
-		link := f.WebContentLink
+		http.Redirect(w, r, file.WebContentLink, http.StatusFound)
+		return
+	}
+
+	err = h.sem.Acquire(ctx, 1)
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+	defer h.sem.Release(1)
+	if (h.fs.c.Config.Download.Connections > 1 || h.fs.blocks != nil) && h.serveRange(w, r, item) {
+		return
+	}
+	resp, err := h.fs.openDownload(ctx, item, func(link string) (*http.Request, error) {
 		req2 := r.Clone(ctx)
-		req2.URL, err = url.Parse(link)
+		u, err := url.Parse(link)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
+			return nil, err
 		}
+		req2.URL = u
+		req2.Host = ""
 		req2.Header.Del("Host")
+		// the credentials are for us, not the download host
+		req2.Header.Del("Authorization")
 		req2.RequestURI = ""
-		h := global.http
-		resp, err := h.Do(req2)
+		return req2, nil
+	})
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+	defer resp.Body.Close()
+	for k, v := range resp.Header {
+		w.Header()[k] = v
+	}
+	setChecksumHeaders(w.Header(), item)
+	code := resp.StatusCode
+	if code == http.StatusServiceUnavailable {
+		// the retry budget is spent, tell the client to back off as well
+		code = http.StatusTooManyRequests
+	}
+	w.WriteHeader(code)
+	h.writeBody(w, h.fs.resumable(ctx, item, resp), item, code == http.StatusOK)
+}
+
+// serveRange serves a file, or a single range of it, through the block cache
+// and concurrent range requests. It returns false without writing anything
+// if the request is better left to the download host, such as multiple or
+// conditional ranges.
+func (h *webdavHandler) serveRange(w http.ResponseWriter, r *http.Request, item *DriveItem) bool {
+	if item.Size == "" || r.Header.Get("If-Range") != "" {
+		return false
+	}
+	size, err := strconv.ParseInt(item.Size, 10, 64)
+	if err != nil || size <= 0 {
+		return false
+	}
+	start, end := int64(0), size-1
+	code := http.StatusOK
+	if s := r.Header.Get("Range"); s != "" {
+		var ok bool
+		start, end, ok = parseSingleRange(s, size)
+		if !ok {
+			return false
+		}
+		code = http.StatusPartialContent
+	}
+
+	ctx := r.Context()
+	body, err := h.fs.openRange(ctx, item, start, end, h.fs.c.Config.Download.Connections)
+	if err != nil {
+		httpError(w, err)
+		return true
+	}
+
+	fi := &fileStat{item}
+	contentType, _ := fi.ContentType(ctx)
+	etag, _ := fi.ETag(ctx)
+	header := w.Header()
+	header.Set("Accept-Ranges", "bytes")
+	header.Set("Content-Type", contentType)
+	header.Set("Content-Length", strconv.FormatInt(end-start+1, 10))
+	header.Set("Last-Modified", fi.ModTime().Format(http.TimeFormat))
+	header.Set("ETag", etag)
+	if code == http.StatusPartialContent {
+		header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, size))
+	}
+	setChecksumHeaders(header, item)
+	w.WriteHeader(code)
+	h.writeBody(w, body, item, code == http.StatusOK)
+	return true
+}
+
+// writeBody copies a download to the client, verifying whole files.
+func (h *webdavHandler) writeBody(w http.ResponseWriter, body io.ReadCloser, item *DriveItem, whole bool) {
+	defer body.Close()
+	if whole {
+		body = verifyDownload(body, item, h.fs.c.Config.VerifyDownloads)
+	}
+	_, err := io.Copy(w, body)
+	if err != nil {
+		// the status is already sent, make sure the client sees a failed
+		// transfer rather than a short one
+		panic(http.ErrAbortHandler)
+	}
+}
+
+func (h *webdavHandler) serveCopy(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	dst, err := url.Parse(r.Header.Get("Destination"))
+	if err != nil || dst.Path == "" {
+		http.Error(w, "invalid destination", http.StatusBadRequest)
+		return
+	}
+	if dst.Host != "" && dst.Host != r.Host {
+		http.Error(w, "destination on another server", http.StatusBadGateway)
+		return
+	}
+
+	recursive := true
+	switch r.Header.Get("Depth") {
+	case "", "infinity":
+	case "0":
+		recursive = false
+	default:
+		http.Error(w, "invalid depth", http.StatusBadRequest)
+		return
+	}
+
+	overwrite := true
+	switch r.Header.Get("Overwrite") {
+	case "", "T":
+	case "F":
+		overwrite = false
+	default:
+		http.Error(w, "invalid overwrite", http.StatusBadRequest)
+		return
+	}
+
+	if sanitizeName(r.URL.Path) == sanitizeName(dst.Path) {
+		http.Error(w, "source and destination are the same", http.StatusForbidden)
+		return
+	}
+
+	release, status, err := h.confirmLocks(r, dst.Path)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+	defer release()
+
+	_, err = h.fs.Stat(ctx, r.URL.Path)
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+
+	_, err = h.fs.Stat(ctx, dst.Path)
+	created := errors.Is(err, os.ErrNotExist)
+	if err != nil && !created {
+		httpError(w, err)
+		return
+	}
+	if !created {
+		if !overwrite {
+			http.Error(w, "destination exists", http.StatusPreconditionFailed)
+			return
+		}
+		err = h.fs.RemoveAll(ctx, dst.Path)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			httpError(w, err)
 			return
 		}
-		defer resp.Body.Close()
-		for k, v := range resp.Header {
-			w.Header()[k] = v
+	}
+
+	err = h.fs.Copy(ctx, r.URL.Path, dst.Path, recursive)
+	switch {
+	case err == nil:
+	case errors.Is(err, os.ErrNotExist):
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	case errors.Is(err, os.ErrExist):
+		http.Error(w, err.Error(), http.StatusPreconditionFailed)
+		return
+	case errors.Is(err, os.ErrInvalid), errors.Is(err, os.ErrPermission):
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	default:
+		httpError(w, err)
+		return
+	}
+
+	if created {
+		w.WriteHeader(http.StatusCreated)
+	} else {
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (h *webdavHandler) serveAdmin(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get(adminHeader) == "" {
+		http.Error(w, adminHeader+" header required", http.StatusForbidden)
+		return
+	}
+
+	switch r.URL.Path {
+	case emptyTrashPath:
+		if r.Method != "POST" {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
 		}
-		code := resp.StatusCode
-		if code == http.StatusServiceUnavailable {
-			code = http.StatusTooManyRequests
-			body, err := io.ReadAll(resp.Body)
-			if err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
-			}
-			w.Header().Set("Retry-After", "10")
-			w.Header().Set("Content-Type", "text/plain")
-			w.WriteHeader(code)
-			// most clients will retry immediately, so we hold the request for a second
-			time.Sleep(1 * time.Second)
-			_, err = w.Write(body)
+		err := h.fs.emptyTrash(r.Context())
+		if os.IsPermission(err) {
+			http.Error(w, "deleting is not allowed", http.StatusForbidden)
 			return
 		}
-		w.WriteHeader(code)
-		_, err = io.Copy(w, resp.Body)
-		return
+		if err != nil {
+			httpError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "not found", http.StatusNotFound)
 	}
-	h.h.ServeHTTP(w, r)
 }
 
 func (c *DriveClient) WebDAV() (http.Handler, error) {
@@ -101,7 +420,7 @@ func (c *DriveClient) WebDAV() (http.Handler, error) {
 	}
 
 	davHandler := &webdav.Handler{
-		FileSystem: fs,
+		FileSystem: reportingFS{fs},
 		LockSystem: webdav.NewMemLS(),
 	}
 	h := &webdavHandler{
@@ -109,6 +428,12 @@ func (c *DriveClient) WebDAV() (http.Handler, error) {
 		fs:  fs,
 		sem: semaphore.NewWeighted(int64(maxDownloadConnections)),
 	}
+	if ua := c.Config.Download.RedirectUserAgent; ua != "" {
+		h.redirectUA, err = regexp.Compile(ua)
+		if err != nil {
+			return nil, err
+		}
+	}
 	c.dav = h
 
 	return h, nil
@@ -1,7 +1,130 @@
 package client
 
-import "errors"
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+)
 
 var (
 	ErrAuthorizationFailed = errors.New("authorization failed")
+	ErrChecksumMismatch    = errors.New("checksum mismatch")
+
+	// The classes of APIError, to be checked with errors.Is.
+	ErrNotFound      = errors.New("not found")
+	ErrForbidden     = errors.New("forbidden")
+	ErrConflict      = errors.New("conflict")
+	ErrLocked        = errors.New("locked")
+	ErrRateLimited   = errors.New("rate limited")
+	ErrQuotaExceeded = errors.New("quota exceeded")
 )
+
+// apiErrorClasses classifies the error field of PikPak API errors.
+var apiErrorClasses = map[string]error{
+	"file_not_found":          ErrNotFound,
+	"file_in_recycle_bin":     ErrNotFound,
+	"task_not_found":          ErrNotFound,
+	"permission_denied":       ErrForbidden,
+	"file_name_empty":         ErrForbidden,
+	"file_name_too_long":      ErrForbidden,
+	"file_duplicated_name":    ErrConflict,
+	"captcha_invalid":         ErrRateLimited,
+	"too_frequent":            ErrRateLimited,
+	"task_run_nums_limit":     ErrRateLimited,
+	"file_space_not_enough":   ErrQuotaExceeded,
+	"task_daily_create_limit": ErrQuotaExceeded,
+}
+
+// apiStatusClasses classifies PikPak API errors by HTTP status where the
+// error field is not known.
+var apiStatusClasses = map[int]error{
+	http.StatusNotFound:            ErrNotFound,
+	http.StatusForbidden:           ErrForbidden,
+	http.StatusConflict:            ErrConflict,
+	http.StatusLocked:              ErrLocked,
+	http.StatusTooManyRequests:     ErrRateLimited,
+	http.StatusInsufficientStorage: ErrQuotaExceeded,
+}
+
+// APIError is an error response of the PikPak API.
+type APIError struct {
+	StatusCode  int    `json:"-"`
+	Code        string `json:"error"`
+	ErrorCode   int    `json:"error_code"`
+	Description string `json:"error_description"`
+	// Body is the raw response if it is not a JSON error.
+	Body string `json:"-"`
+}
+
+// newAPIError parses an error response.
+func newAPIError(statusCode int, body []byte) *APIError {
+	e := &APIError{StatusCode: statusCode}
+	if json.Unmarshal(body, e) != nil || e.Code == "" {
+		e.Body = string(body)
+	}
+	return e
+}
+
+func (e *APIError) Error() string {
+	if e.Code == "" {
+		return fmt.Sprintf("pikpak: status %d: %s", e.StatusCode, e.Body)
+	}
+	if e.Description == "" {
+		return fmt.Sprintf("pikpak: %s (%d)", e.Code, e.ErrorCode)
+	}
+	return fmt.Sprintf("pikpak: %s (%d): %s", e.Code, e.ErrorCode, e.Description)
+}
+
+// class returns the sentinel error e falls under, or nil.
+func (e *APIError) class() error {
+	if class, ok := apiErrorClasses[e.Code]; ok {
+		return class
+	}
+	return apiStatusClasses[e.StatusCode]
+}
+
+// Is reports whether e falls under target, one of the sentinel errors of
+// this package or the matching os error.
+func (e *APIError) Is(target error) bool {
+	class := e.class()
+	if class == nil {
+		return false
+	}
+	switch target {
+	case class:
+		return true
+	case os.ErrNotExist:
+		return class == ErrNotFound
+	case os.ErrPermission:
+		return class == ErrForbidden
+	case os.ErrExist:
+		return class == ErrConflict
+	}
+	return false
+}
+
+// errorStatus returns the HTTP status err should be answered with.
+func errorStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrNotFound), errors.Is(err, os.ErrNotExist):
+		return http.StatusNotFound
+	case errors.Is(err, ErrForbidden), errors.Is(err, os.ErrPermission):
+		return http.StatusForbidden
+	case errors.Is(err, ErrConflict), errors.Is(err, os.ErrExist):
+		return http.StatusConflict
+	case errors.Is(err, ErrLocked):
+		return http.StatusLocked
+	case errors.Is(err, ErrRateLimited):
+		return http.StatusTooManyRequests
+	case errors.Is(err, ErrQuotaExceeded):
+		return http.StatusInsufficientStorage
+	}
+	return http.StatusInternalServerError
+}
+
+// httpError answers a request with err and the matching status.
+func httpError(w http.ResponseWriter, err error) {
+	http.Error(w, err.Error(), errorStatus(err))
+}
@@ -0,0 +1,116 @@
+// Package gcid implements PikPak's GCID content hash.
+//
+// The content is split into blocks whose size depends on the total size of
+// the content, and the GCID is the SHA-1 of the concatenated SHA-1 digests
+// of all blocks.
+package gcid
+
+import (
+	"crypto/sha1"
+	"encoding"
+	"encoding/hex"
+	"hash"
+	"io"
+	"strings"
+)
+
+const (
+	// Size is the size of a GCID in bytes.
+	Size = sha1.Size
+
+	minBlockSize = 256 << 10
+	maxBlockSize = 2 << 20
+	maxBlocks    = 512
+)
+
+// BlockSize returns the size of the blocks content of the given size is
+// split into. Blocks start at 256 KiB and double until there are at most 512
+// of them, up to 2 MiB.
+func BlockSize(size int64) int64 {
+	blockSize := int64(minBlockSize)
+	for size > blockSize*maxBlocks && blockSize < maxBlockSize {
+		blockSize <<= 1
+	}
+	return blockSize
+}
+
+type digest struct {
+	blockSize int64
+	total     hash.Hash
+	block     hash.Hash
+	n         int64
+}
+
+// New returns a hash.Hash computing the GCID of content of the given size.
+// The size must be known up front, as it determines the block size.
+func New(size int64) hash.Hash {
+	return &digest{
+		blockSize: BlockSize(size),
+		total:     sha1.New(),
+		block:     sha1.New(),
+	}
+}
+
+func (d *digest) Write(p []byte) (int, error) {
+	written := len(p)
+	for len(p) > 0 {
+		m := d.blockSize - d.n
+		if int64(len(p)) < m {
+			m = int64(len(p))
+		}
+		d.block.Write(p[:m])
+		d.n += m
+		p = p[m:]
+		if d.n == d.blockSize {
+			d.total.Write(d.block.Sum(nil))
+			d.block.Reset()
+			d.n = 0
+		}
+	}
+	return written, nil
+}
+
+func (d *digest) Sum(b []byte) []byte {
+	// work on a copy of the running total, Sum must not change the state
+	total := sha1.New()
+	state, err := d.total.(encoding.BinaryMarshaler).MarshalBinary()
+	if err != nil {
+		panic(err)
+	}
+	err = total.(encoding.BinaryUnmarshaler).UnmarshalBinary(state)
+	if err != nil {
+		panic(err)
+	}
+	if d.n > 0 {
+		total.Write(d.block.Sum(nil))
+	}
+	return total.Sum(b)
+}
+
+func (d *digest) Reset() {
+	d.total.Reset()
+	d.block.Reset()
+	d.n = 0
+}
+
+func (d *digest) Size() int {
+	return Size
+}
+
+func (d *digest) BlockSize() int {
+	return sha1.BlockSize
+}
+
+// Sum reads size bytes from r and returns their GCID in upper case hex, the
+// way PikPak reports it.
+func Sum(r io.Reader, size int64) (string, error) {
+	h := New(size)
+	n, err := io.Copy(h, io.LimitReader(r, size))
+	if err != nil {
+		return "", err
+	}
+	if n != size {
+		return "", io.ErrUnexpectedEOF
+	}
+	return strings.ToUpper(hex.EncodeToString(h.Sum(nil))), nil
+}
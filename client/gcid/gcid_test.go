@@ -0,0 +1,105 @@
+package gcid
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io"
+	"strings"
+	"testing"
+)
+
+// pattern yields the bytes 0 to 250, repeated.
+type pattern struct {
+	off int64
+}
+
+func (p *pattern) Read(b []byte) (int, error) {
+	for i := range b {
+		b[i] = byte(p.off % 251)
+		p.off++
+	}
+	return len(b), nil
+}
+
+func TestBlockSize(t *testing.T) {
+	tests := []struct {
+		size      int64
+		blockSize int64
+	}{
+		{0, 256 << 10},
+		{128 << 20, 256 << 10},
+		{128<<20 + 1, 512 << 10},
+		{256 << 20, 512 << 10},
+		{256<<20 + 1, 1 << 20},
+		{512 << 20, 1 << 20},
+		{512<<20 + 1, 2 << 20},
+		{1 << 40, 2 << 20},
+	}
+	for _, test := range tests {
+		if got := BlockSize(test.size); got != test.blockSize {
+			t.Errorf("BlockSize(%d) = %d, want %d", test.size, got, test.blockSize)
+		}
+	}
+}
+
+func TestSum(t *testing.T) {
+	tests := []struct {
+		size int64
+		gcid string
+	}{
+		{0, "DA39A3EE5E6B4B0D3255BFEF95601890AFD80709"},
+		{1, "7AB8DC8456C25F132551F157C77A1888EF918FAC"},
+		{1000, "D138DC3DDB4CB82BBE04457119AB134D2B376092"},
+		{256 << 10, "F43C5D94B1F43CD4665DAC585073FF87FF44ED68"},
+		{256<<10 + 1, "B49C2F0058570F636C866EA282DD5CC9463416E8"},
+		{128 << 20, "9B84D1F47CD29D705A00D68ADF0F91930B35E33D"},
+		{128<<20 + 1, "6F88A56B3716096BD032A0A8D04604687205EBDE"},
+		{256<<20 + 1, "73F2B6F402CDF07434F4595F0E302D3DE37289CA"},
+	}
+	for _, test := range tests {
+		if testing.Short() && test.size > 1<<20 {
+			continue
+		}
+		gcid, err := Sum(&pattern{}, test.size)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if gcid != test.gcid {
+			t.Errorf("Sum of %d bytes = %s, want %s", test.size, gcid, test.gcid)
+		}
+	}
+}
+
+func TestSumShortRead(t *testing.T) {
+	_, err := Sum(bytes.NewReader(make([]byte, 10)), 11)
+	if err != io.ErrUnexpectedEOF {
+		t.Errorf("got %v, want %v", err, io.ErrUnexpectedEOF)
+	}
+}
+
+func TestWriteChunks(t *testing.T) {
+	const size = 3*256<<10 + 12345
+	data := make([]byte, size)
+	(&pattern{}).Read(data)
+
+	// uneven writes across block boundaries, with Sum in between
+	h := New(size)
+	for off := 0; off < size; {
+		n := 100003
+		if off+n > size {
+			n = size - off
+		}
+		h.Write(data[off : off+n])
+		off += n
+		h.Sum(nil)
+	}
+	got := strings.ToUpper(hex.EncodeToString(h.Sum(nil)))
+
+	want, err := Sum(bytes.NewReader(data), size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != want {
+		t.Errorf("chunked writes give %s, want %s", got, want)
+	}
+}
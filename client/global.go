@@ -1,9 +1,11 @@
 package client
 
 import (
+	"errors"
 	"io/ioutil"
 	"net/http"
 	"regexp"
+	"sync"
 
 	"github.com/flynn/json5"
 	"github.com/rs/zerolog/log"
@@ -71,40 +73,64 @@ func init() {
 	global.http = &http.Client{}
 	*global.http = *http.DefaultClient
 	global.http.Transport = &globalRoundTripper{}
+}
+
+var (
+	globalMu     sync.Mutex
+	globalLoaded bool
+)
+
+// loadGlobal fetches the client identity of the PikPak web app on first use
+// rather than when the package is loaded. A failed fetch is tried again on
+// the next call, so that a short outage does not break the process for good.
+func loadGlobal() error {
+	globalMu.Lock()
+	defer globalMu.Unlock()
+
+	if globalLoaded {
+		return nil
+	}
+	loaded := globalEnv{http: global.http}
+	err := loaded.load()
+	if err != nil {
+		return err
+	}
+	global = loaded
+	globalLoaded = true
+	return nil
+}
 
+func (g *globalEnv) load() error {
 	resp1, err := http.Get(baseURL + "/drive")
 	if err != nil {
-		panic(err)
+		return err
 	}
 
 	defer resp1.Body.Close()
 	body1, err := ioutil.ReadAll(resp1.Body)
 	if err != nil {
-		panic(err)
+		return err
 	}
 	mainJs := string(mainJsRegexp.Find(body1))
 	if mainJs == "" {
-		panic("could not find main js file")
+		return errors.New("could not find main js file")
 	}
 
 	resp2, err := http.Get(baseURL + mainJs)
 	if err != nil {
-		panic(err)
+		return err
 	}
 	defer resp2.Body.Close()
 	body2, err := ioutil.ReadAll(resp2.Body)
 	if err != nil {
-		panic(err)
+		return err
 	}
 
-	global.ClientID = findFirstStringSubmatch(clientIDRegexp, string(body2))
-	global.ClientVersion = findFirstStringSubmatch(clientVersionRegexp, string(body2))
-	global.PackageName = findFirstStringSubmatch(packageNameRegexp, string(body2))
-	global.Timestamp = findFirstStringSubmatch(timestampRegexp, string(body2))
+	g.ClientID = findFirstStringSubmatch(clientIDRegexp, string(body2))
+	g.ClientVersion = findFirstStringSubmatch(clientVersionRegexp, string(body2))
+	g.PackageName = findFirstStringSubmatch(packageNameRegexp, string(body2))
+	g.Timestamp = findFirstStringSubmatch(timestampRegexp, string(body2))
 
 	algorithms := findFirstStringSubmatch(algorithmsRegexp, string(body2))
-	err = json5.Unmarshal([]byte(algorithms), &global.SigningAlgorithms)
-	if err != nil {
-		panic(err)
-	}
+	return json5.Unmarshal([]byte(algorithms), &g.SigningAlgorithms)
 }
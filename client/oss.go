@@ -0,0 +1,169 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+var (
+	ossPartRetries = 3
+	ossRetryDelay  = 1 * time.Second
+)
+
+// ossParams are the temporary object storage credentials PikPak hands out
+// for resumable uploads.
+type ossParams struct {
+	AccessKeyID     string `json:"access_key_id"`
+	AccessKeySecret string `json:"access_key_secret"`
+	Bucket          string `json:"bucket"`
+	Endpoint        string `json:"endpoint"`
+	Expiration      string `json:"expiration"`
+	Key             string `json:"key"`
+	SecurityToken   string `json:"security_token"`
+}
+
+type ossPart struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+type ossInitiateResult struct {
+	UploadID string `xml:"UploadId"`
+}
+
+type ossCompleteRequest struct {
+	XMLName xml.Name  `xml:"CompleteMultipartUpload"`
+	Parts   []ossPart `xml:"Part"`
+}
+
+// ossMultipartUpload is a multipart upload of a single object to Aliyun OSS,
+// signed with the STS credentials from ossParams.
+type ossMultipartUpload struct {
+	params   ossParams
+	uploadID string
+	parts    []ossPart
+}
+
+func (o *ossMultipartUpload) url(subresource string) string {
+	host := o.params.Endpoint
+	if !strings.HasPrefix(host, o.params.Bucket+".") {
+		host = o.params.Bucket + "." + host
+	}
+	return "https://" + host + (&url.URL{Path: "/" + o.params.Key}).EscapedPath() + "?" + subresource
+}
+
+// do sends a signed request. subresource must already be in canonical
+// (sorted) order.
+func (o *ossMultipartUpload) do(ctx context.Context, method string, subresource string, contentType string, body []byte) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, o.url(subresource), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	date := time.Now().UTC().Format(http.TimeFormat)
+	req.Header.Set("Date", date)
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	req.Header.Set("x-oss-security-token", o.params.SecurityToken)
+
+	toSign := method + "\n" +
+		"\n" +
+		contentType + "\n" +
+		date + "\n" +
+		"x-oss-security-token:" + o.params.SecurityToken + "\n" +
+		"/" + o.params.Bucket + "/" + o.params.Key + "?" + subresource
+	mac := hmac.New(sha1.New, []byte(o.params.AccessKeySecret))
+	mac.Write([]byte(toSign))
+	req.Header.Set("Authorization", "OSS "+o.params.AccessKeyID+":"+base64.StdEncoding.EncodeToString(mac.Sum(nil)))
+
+	resp, err := global.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		defer resp.Body.Close()
+		respBody, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("oss: %s: %s", resp.Status, respBody)
+	}
+	return resp, nil
+}
+
+func (o *ossMultipartUpload) initiate(ctx context.Context) error {
+	resp, err := o.do(ctx, "POST", "uploads", "", nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	var result ossInitiateResult
+	err = xml.NewDecoder(resp.Body).Decode(&result)
+	if err != nil {
+		return err
+	}
+	if result.UploadID == "" {
+		return fmt.Errorf("oss: no upload id in response")
+	}
+	o.uploadID = result.UploadID
+	return nil
+}
+
+// uploadPart uploads the next part, retrying transient failures so that a
+// single bad part does not restart the whole upload.
+func (o *ossMultipartUpload) uploadPart(ctx context.Context, data []byte) error {
+	partNumber := len(o.parts) + 1
+	subresource := fmt.Sprintf("partNumber=%d&uploadId=%s", partNumber, o.uploadID)
+
+	var err error
+	for i := 0; i < ossPartRetries; i++ {
+		if i > 0 {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(ossRetryDelay << (i - 1)):
+			}
+		}
+
+		var resp *http.Response
+		resp, err = o.do(ctx, "PUT", subresource, "", data)
+		if err != nil {
+			continue
+		}
+		resp.Body.Close()
+		o.parts = append(o.parts, ossPart{
+			PartNumber: partNumber,
+			ETag:       resp.Header.Get("ETag"),
+		})
+		return nil
+	}
+	return err
+}
+
+func (o *ossMultipartUpload) complete(ctx context.Context) error {
+	body, err := xml.Marshal(&ossCompleteRequest{Parts: o.parts})
+	if err != nil {
+		return err
+	}
+	resp, err := o.do(ctx, "POST", "uploadId="+o.uploadID, "application/xml", body)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+func (o *ossMultipartUpload) abort(ctx context.Context) error {
+	resp, err := o.do(ctx, "DELETE", "uploadId="+o.uploadID, "", nil)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
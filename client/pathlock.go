@@ -0,0 +1,61 @@
+package client
+
+import (
+	"sort"
+	"sync"
+)
+
+// pathLocks is a set of mutexes keyed by path, created on demand and dropped
+// once unused.
+type pathLocks struct {
+	mu    sync.Mutex
+	locks map[string]*pathLock
+}
+
+type pathLock struct {
+	sync.Mutex
+	refs int
+}
+
+// lock locks the given paths and returns a function unlocking them. Paths
+// are locked in a fixed order, so that callers locking overlapping sets do
+// not deadlock.
+func (l *pathLocks) lock(names ...string) func() {
+	names = append([]string(nil), names...)
+	sort.Strings(names)
+
+	var held []*pathLock
+	for i, name := range names {
+		if i > 0 && name == names[i-1] {
+			continue
+		}
+		l.mu.Lock()
+		if l.locks == nil {
+			l.locks = map[string]*pathLock{}
+		}
+		pl := l.locks[name]
+		if pl == nil {
+			pl = &pathLock{}
+			l.locks[name] = pl
+		}
+		pl.refs++
+		l.mu.Unlock()
+
+		pl.Lock()
+		held = append(held, pl)
+	}
+
+	return func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		for i := len(held) - 1; i >= 0; i-- {
+			held[i].Unlock()
+			held[i].refs--
+		}
+		for _, name := range names {
+			if pl := l.locks[name]; pl != nil && pl.refs == 0 {
+				delete(l.locks, name)
+			}
+		}
+	}
+}
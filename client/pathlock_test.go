@@ -0,0 +1,58 @@
+package client
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestPathLocksExclusive(t *testing.T) {
+	var l pathLocks
+	paths := []string{"/a", "/b", "/c"}
+	held := map[string]bool{}
+	var heldMu sync.Mutex
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		// overlapping sets, locked in different orders
+		names := []string{paths[i%3], paths[(i+1)%3]}
+		if i%2 == 1 {
+			names[0], names[1] = names[1], names[0]
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				unlock := l.lock(names...)
+				heldMu.Lock()
+				for _, name := range names {
+					if held[name] {
+						t.Errorf("%s locked twice", name)
+					}
+					held[name] = true
+				}
+				heldMu.Unlock()
+
+				heldMu.Lock()
+				for _, name := range names {
+					held[name] = false
+				}
+				heldMu.Unlock()
+				unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if len(l.locks) != 0 {
+		t.Errorf("%d locks left after unlocking", len(l.locks))
+	}
+}
+
+func TestPathLocksDuplicates(t *testing.T) {
+	var l pathLocks
+	unlock := l.lock("/a", "/a")
+	unlock()
+	if len(l.locks) != 0 {
+		t.Errorf("%d locks left after unlocking", len(l.locks))
+	}
+}
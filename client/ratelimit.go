@@ -0,0 +1,175 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	defaultAPIRate        = 5.0
+	defaultAPIBurst       = 10
+	defaultAPIMaxInflight = 4
+
+	// rateLimitPause is how long API calls are paused when PikPak reports
+	// rate limiting without saying for how long.
+	rateLimitPause = 10 * time.Second
+	// maxErrorBodySize bounds error responses read to look for rate
+	// limiting.
+	maxErrorBodySize int64 = 64 << 10
+)
+
+// rateLimiter is a token bucket handing out rate tokens per second, saving
+// up to burst of them. It can be paused when the API asks to back off.
+type rateLimiter struct {
+	rate  float64
+	burst float64
+	now   func() time.Time
+
+	mu          sync.Mutex
+	tokens      float64
+	last        time.Time
+	pausedUntil time.Time
+}
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &rateLimiter{
+		rate:   rate,
+		burst:  float64(burst),
+		now:    time.Now,
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// wait blocks until a token is available.
+func (l *rateLimiter) wait(ctx context.Context) error {
+	for {
+		delay := l.reserve()
+		if delay == 0 {
+			return nil
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// reserve takes a token if one is available, and otherwise returns how long
+// to wait before trying again.
+func (l *rateLimiter) reserve() time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	if now.Before(l.pausedUntil) {
+		return l.pausedUntil.Sub(now)
+	}
+	if now.After(l.last) {
+		l.tokens += now.Sub(l.last).Seconds() * l.rate
+		if l.tokens > l.burst {
+			l.tokens = l.burst
+		}
+		l.last = now
+	}
+	if l.tokens >= 1 {
+		l.tokens--
+		return 0
+	}
+	// never zero, which would mean a token was taken
+	return time.Duration((1-l.tokens)/l.rate*float64(time.Second)) + 1
+}
+
+// pause hands out no tokens for d, and drops the ones saved up, so that
+// calls resume slowly afterwards.
+func (l *rateLimiter) pause(d time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	until := l.now().Add(d)
+	if until.After(l.pausedUntil) {
+		l.pausedUntil = until
+	}
+	l.tokens = 0
+	l.last = l.pausedUntil
+}
+
+// rateLimitDelay tells whether resp reports rate limiting, and for how long
+// to back off. The body of error responses is read to find PikPak's error
+// code, and replaced for the caller.
+func rateLimitDelay(resp *http.Response) (time.Duration, bool) {
+	if resp.StatusCode == http.StatusOK {
+		return 0, false
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxErrorBodySize))
+	resp.Body.Close()
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	if err != nil {
+		return 0, false
+	}
+	if !errors.Is(newAPIError(resp.StatusCode, body), ErrRateLimited) &&
+		resp.StatusCode != http.StatusServiceUnavailable {
+		return 0, false
+	}
+
+	if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if t, err := http.ParseTime(resp.Header.Get("Retry-After")); err == nil && time.Until(t) > 0 {
+		return time.Until(t), true
+	}
+	return rateLimitPause, true
+}
+
+// releaseBody calls release once the body is closed.
+type releaseBody struct {
+	io.ReadCloser
+	once    sync.Once
+	release func()
+}
+
+func (b *releaseBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.release)
+	return err
+}
+
+// limitRequest waits for the rate limiter and a free in-flight slot. The
+// returned function gives the slot back.
+func (p *driveRoundTripper) limitRequest(ctx context.Context) (func(), error) {
+	err := p.inflight.Acquire(ctx, 1)
+	if err != nil {
+		return nil, err
+	}
+	err = p.limiter.wait(ctx)
+	if err != nil {
+		p.inflight.Release(1)
+		return nil, err
+	}
+	return func() { p.inflight.Release(1) }, nil
+}
+
+// checkRateLimit pauses the rate limiter if resp reports rate limiting.
+func (p *driveRoundTripper) checkRateLimit(resp *http.Response) {
+	delay, limited := rateLimitDelay(resp)
+	if !limited {
+		return
+	}
+	log.Warn().Str("user", p.Config.User.Username).Dur("pause", delay).Msg("rate limited by PikPak, pausing API calls")
+	p.limiter.pause(delay)
+}
@@ -0,0 +1,179 @@
+package client
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/sync/semaphore"
+)
+
+// testClock is a clock that only moves when told to.
+type testClock struct {
+	t time.Time
+}
+
+func (c *testClock) now() time.Time          { return c.t }
+func (c *testClock) advance(d time.Duration) { c.t = c.t.Add(d) }
+
+func newTestRateLimiter(rate float64, burst int) (*rateLimiter, *testClock) {
+	clock := &testClock{t: time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)}
+	l := newRateLimiter(rate, burst)
+	l.now = clock.now
+	l.last = clock.t
+	return l, clock
+}
+
+// expectDelay checks the next reservation, up to rounding.
+func expectDelay(t *testing.T, l *rateLimiter, want time.Duration) {
+	t.Helper()
+	got := l.reserve()
+	if got < want || got > want+time.Microsecond || (want == 0) != (got == 0) {
+		t.Errorf("reserve() = %v, want %v", got, want)
+	}
+}
+
+func TestRateLimiterBucket(t *testing.T) {
+	l, clock := newTestRateLimiter(2, 3)
+
+	// the burst is available right away
+	for i := 0; i < 3; i++ {
+		expectDelay(t, l, 0)
+	}
+	expectDelay(t, l, 500*time.Millisecond)
+	clock.advance(250 * time.Millisecond)
+	expectDelay(t, l, 250*time.Millisecond)
+	clock.advance(250 * time.Millisecond)
+	expectDelay(t, l, 0)
+
+	// no more than the burst is saved up
+	clock.advance(time.Hour)
+	for i := 0; i < 3; i++ {
+		expectDelay(t, l, 0)
+	}
+	expectDelay(t, l, 500*time.Millisecond)
+}
+
+func TestRateLimiterPause(t *testing.T) {
+	l, clock := newTestRateLimiter(2, 3)
+
+	l.pause(5 * time.Second)
+	expectDelay(t, l, 5*time.Second)
+	// a shorter pause does not cut the running one short
+	l.pause(time.Second)
+	expectDelay(t, l, 5*time.Second)
+
+	clock.advance(5 * time.Second)
+	// saved up tokens were dropped, calls resume at the rate
+	expectDelay(t, l, 500*time.Millisecond)
+	clock.advance(500 * time.Millisecond)
+	expectDelay(t, l, 0)
+	expectDelay(t, l, 500*time.Millisecond)
+}
+
+func TestRateLimiterWait(t *testing.T) {
+	l, _ := newTestRateLimiter(2, 1)
+	if err := l.wait(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// the clock is stopped, waiting for the next token never ends
+	l.pause(time.Hour)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := l.wait(ctx); err != context.DeadlineExceeded {
+		t.Errorf("wait = %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestRateLimitDelay(t *testing.T) {
+	inAnHour := time.Now().Add(time.Hour).UTC().Format(http.TimeFormat)
+	tests := []struct {
+		name       string
+		status     int
+		retryAfter string
+		body       string
+		delay      time.Duration
+		limited    bool
+	}{
+		{"ok", http.StatusOK, "", "{}", 0, false},
+		{"not found", http.StatusNotFound, "", `{"error":"file_not_found"}`, 0, false},
+		{"too many requests", http.StatusTooManyRequests, "", "", rateLimitPause, true},
+		{"numeric Retry-After", http.StatusTooManyRequests, "7", "", 7 * time.Second, true},
+		{"HTTP date Retry-After", http.StatusServiceUnavailable, inAnHour, "", time.Hour, true},
+		{"past Retry-After", http.StatusServiceUnavailable, "Mon, 01 Jan 2001 00:00:00 GMT", "", rateLimitPause, true},
+		{"too_frequent", http.StatusBadRequest, "", `{"error":"too_frequent","error_code":10}`, rateLimitPause, true},
+		{"too_frequent with Retry-After", http.StatusBadRequest, "3", `{"error":"too_frequent"}`, 3 * time.Second, true},
+	}
+	for _, test := range tests {
+		resp := &http.Response{
+			StatusCode: test.status,
+			Header:     http.Header{},
+			Body:       io.NopCloser(strings.NewReader(test.body)),
+		}
+		if test.retryAfter != "" {
+			resp.Header.Set("Retry-After", test.retryAfter)
+		}
+		delay, limited := rateLimitDelay(resp)
+		if limited != test.limited {
+			t.Errorf("%s: limited = %v, want %v", test.name, limited, test.limited)
+		}
+		// HTTP dates have a resolution of seconds
+		if delay > test.delay || delay < test.delay-2*time.Second {
+			t.Errorf("%s: delay = %v, want %v", test.name, delay, test.delay)
+		}
+		// the body is left for the caller
+		body, _ := io.ReadAll(resp.Body)
+		if string(body) != test.body {
+			t.Errorf("%s: body = %q, want %q", test.name, body, test.body)
+		}
+	}
+}
+
+func TestLimitRequestInflight(t *testing.T) {
+	p := &driveRoundTripper{
+		limiter:  newRateLimiter(1000, 10),
+		inflight: semaphore.NewWeighted(2),
+	}
+	ctx := context.Background()
+
+	release1, err := p.limitRequest(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	release2, err := p.limitRequest(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	full, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	if _, err := p.limitRequest(full); err != context.DeadlineExceeded {
+		t.Errorf("third call in flight: %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	release1()
+	release3, err := p.limitRequest(ctx)
+	if err != nil {
+		t.Fatalf("call after a release: %v", err)
+	}
+	release2()
+	release3()
+
+	// releasing a response body gives the slot back once
+	body := &releaseBody{ReadCloser: io.NopCloser(strings.NewReader("")), release: func() { p.inflight.Release(1) }}
+	if _, err := p.limitRequest(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.limitRequest(ctx); err != nil {
+		t.Fatal(err)
+	}
+	body.Close()
+	body.Close()
+	if !p.inflight.TryAcquire(1) || p.inflight.TryAcquire(1) {
+		t.Error("closing a body twice released more than one slot")
+	}
+}
@@ -0,0 +1,140 @@
+package client
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"net/url"
+	"strconv"
+)
+
+var errInvalidTorrent = errors.New("invalid torrent file")
+
+// maxBencodeDepth limits the nesting of lists and dictionaries, so that a
+// crafted file cannot overflow the stack. Real torrents nest a few levels.
+const maxBencodeDepth = 64
+
+// bencodeSkip returns the offset just past the bencoded value starting at i.
+func bencodeSkip(b []byte, i int) (int, error) {
+	return bencodeSkipDepth(b, i, 0)
+}
+
+func bencodeSkipDepth(b []byte, i int, depth int) (int, error) {
+	if i >= len(b) || depth > maxBencodeDepth {
+		return 0, errInvalidTorrent
+	}
+	switch c := b[i]; {
+	case c == 'i':
+		end := bytes.IndexByte(b[i:], 'e')
+		if end < 0 {
+			return 0, errInvalidTorrent
+		}
+		return i + end + 1, nil
+	case c == 'l' || c == 'd':
+		i++
+		for i < len(b) && b[i] != 'e' {
+			var err error
+			i, err = bencodeSkipDepth(b, i, depth+1)
+			if err != nil {
+				return 0, err
+			}
+		}
+		if i >= len(b) {
+			return 0, errInvalidTorrent
+		}
+		return i + 1, nil
+	case c >= '0' && c <= '9':
+		_, end, err := bencodeString(b, i)
+		return end, err
+	}
+	return 0, errInvalidTorrent
+}
+
+// bencodeString decodes the bencoded string starting at i and returns it
+// along with the offset just past it.
+func bencodeString(b []byte, i int) (string, int, error) {
+	colon := bytes.IndexByte(b[i:], ':')
+	if colon < 0 {
+		return "", 0, errInvalidTorrent
+	}
+	n, err := strconv.Atoi(string(b[i : i+colon]))
+	if err != nil || n < 0 {
+		return "", 0, errInvalidTorrent
+	}
+	start := i + colon + 1
+	if n > len(b)-start {
+		return "", 0, errInvalidTorrent
+	}
+	return string(b[start : start+n]), start + n, nil
+}
+
+// bencodeDict calls fn for every key of the bencoded dictionary starting at
+// i, with the offsets of the value. It returns the offset just past the
+// dictionary.
+func bencodeDict(b []byte, i int, fn func(key string, start, end int)) (int, error) {
+	if i >= len(b) || b[i] != 'd' {
+		return 0, errInvalidTorrent
+	}
+	i++
+	for i < len(b) && b[i] != 'e' {
+		key, start, err := bencodeString(b, i)
+		if err != nil {
+			return 0, err
+		}
+		end, err := bencodeSkip(b, start)
+		if err != nil {
+			return 0, err
+		}
+		fn(key, start, end)
+		i = end
+	}
+	if i >= len(b) {
+		return 0, errInvalidTorrent
+	}
+	return i + 1, nil
+}
+
+// torrentMagnet converts a .torrent file into a magnet link. The info hash
+// is the SHA-1 of the raw bencoded info dictionary.
+func torrentMagnet(b []byte) (string, error) {
+	var info []byte
+	var trackers []string
+	_, err := bencodeDict(b, 0, func(key string, start, end int) {
+		switch key {
+		case "info":
+			info = b[start:end]
+		case "announce":
+			tracker, _, err := bencodeString(b, start)
+			if err == nil {
+				trackers = append(trackers, tracker)
+			}
+		}
+	})
+	if err != nil {
+		return "", err
+	}
+	if info == nil {
+		return "", errInvalidTorrent
+	}
+
+	var name string
+	_, err = bencodeDict(info, 0, func(key string, start, end int) {
+		if key == "name" {
+			name, _, _ = bencodeString(info, start)
+		}
+	})
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha1.Sum(info)
+	magnet := "magnet:?xt=urn:btih:" + hex.EncodeToString(sum[:])
+	if name != "" {
+		magnet += "&dn=" + url.QueryEscape(name)
+	}
+	for _, tracker := range trackers {
+		magnet += "&tr=" + url.QueryEscape(tracker)
+	}
+	return magnet, nil
+}
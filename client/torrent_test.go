@@ -0,0 +1,82 @@
+package client
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+var (
+	testPieces     = strings.Repeat("x", 20)
+	testSingleInfo = "d6:lengthi5e4:name9:a b&c.txt12:piece lengthi16384e6:pieces20:" + testPieces + "e"
+	testSingle     = "d8:announce31:http://tracker.example/announce4:info" + testSingleInfo + "e"
+	testMultiInfo  = "d5:filesld6:lengthi1e4:pathl1:aeed6:lengthi2e4:pathl3:sub1:beee4:name3:dir12:piece lengthi16384e6:pieces20:" + testPieces + "e"
+	testMulti      = "d7:comment2:hi4:info" + testMultiInfo + "e"
+
+	testSingleMagnet = "magnet:?xt=urn:btih:fd96326b045c7a23b4bc1fed4e8b3ac93d7aa6f6&dn=a+b%26c.txt&tr=http%3A%2F%2Ftracker.example%2Fannounce"
+	testMultiMagnet  = "magnet:?xt=urn:btih:bf248b5efc10028ce3f500a5d929b60952fbbf15&dn=dir"
+)
+
+func TestTorrentMagnet(t *testing.T) {
+	tests := []struct {
+		name    string
+		torrent string
+		magnet  string
+	}{
+		{"single file", testSingle, testSingleMagnet},
+		{"multiple files", testMulti, testMultiMagnet},
+		{"empty", "", ""},
+		{"no info", "d8:announce3:abce", ""},
+		{"info not a dictionary", "d4:infoi1ee", ""},
+		{"truncated string", "d4:info" + testSingleInfo[:40], ""},
+		{"string longer than file", "d4:info99999:abce", ""},
+		{"negative string length", "d4:info-1:e", ""},
+		{"unterminated integer", "d4:infoi1", ""},
+		{"unterminated dictionary", "d4:info" + testSingleInfo, ""},
+		{"deeply nested", "d4:info" + strings.Repeat("l", 1<<20) + strings.Repeat("e", 1<<20) + "e", ""},
+		{"nested beyond file", "d4:info" + strings.Repeat("l", 100), ""},
+	}
+	for _, test := range tests {
+		magnet, err := torrentMagnet([]byte(test.torrent))
+		if test.magnet == "" {
+			if err != errInvalidTorrent {
+				t.Errorf("%s: got %q, %v, want %v", test.name, magnet, err, errInvalidTorrent)
+			}
+			continue
+		}
+		if err != nil || magnet != test.magnet {
+			t.Errorf("%s: got %q, %v, want %q", test.name, magnet, err, test.magnet)
+		}
+	}
+}
+
+func TestOfflineLinks(t *testing.T) {
+	tests := []struct {
+		name  string
+		file  string
+		data  string
+		links []string
+		err   error
+	}{
+		{"torrent", "a.torrent", testSingle, []string{testSingleMagnet}, nil},
+		{"torrent without extension", "a.txt", testMulti, []string{testMultiMagnet}, nil},
+		{"broken torrent", "a.torrent", "d4:info", nil, errInvalidTorrent},
+		{"magnet", "a.magnet", "magnet:?xt=urn:btih:abc\n", []string{"magnet:?xt=urn:btih:abc"}, nil},
+		{"url shortcut", "a.url", "[InternetShortcut]\r\nURL=https://example.com/a.mkv\r\n", []string{"https://example.com/a.mkv"}, nil},
+		{"mixed list", "links.txt", "# downloads\n  HTTP://example.com/a\nnot a link\nftp://example.com/b\r\ned2k://|file|c|1|abc|/\nhttps://\nMAGNET:?xt=urn:btih:abc\n", []string{
+			"HTTP://example.com/a",
+			"ftp://example.com/b",
+			"ed2k://|file|c|1|abc|/",
+			"MAGNET:?xt=urn:btih:abc",
+		}, nil},
+		{"d prefixed list", "links.txt", "download: https://example.com/a\nhttps://example.com/b\n", []string{"https://example.com/b"}, nil},
+		{"no links", "a.txt", "hello\n", nil, errOfflineNoLinks},
+		{"empty", "a.txt", "", nil, errOfflineNoLinks},
+	}
+	for _, test := range tests {
+		links, err := offlineLinks(test.file, []byte(test.data))
+		if err != test.err || !reflect.DeepEqual(links, test.links) {
+			t.Errorf("%s: got %q, %v, want %q, %v", test.name, links, err, test.links, test.err)
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package client
+
+import (
+	"encoding/hex"
+	"hash"
+	"io"
+	"strings"
+
+	"github.com/gyf304/pikpakdav/client/gcid"
+)
+
+// verifyReader checks the GCID of a complete download as it is read. On a
+// mismatch, the last chunk is withheld and ErrChecksumMismatch returned, so
+// that the corrupted content is never delivered in full.
+type verifyReader struct {
+	rc        io.ReadCloser
+	h         hash.Hash
+	remaining int64
+	want      string
+}
+
+// verifyDownload wraps the body of a download of the whole of item, if
+// verification is enabled and PikPak knows the item's hash.
+func verifyDownload(rc io.ReadCloser, item *DriveItem, enabled bool) io.ReadCloser {
+	if !enabled || item.Hash == "" {
+		return rc
+	}
+	size := (&fileStat{f: item}).Size()
+	return &verifyReader{
+		rc:        rc,
+		h:         gcid.New(size),
+		remaining: size,
+		want:      item.Hash,
+	}
+}
+
+func (v *verifyReader) Read(p []byte) (int, error) {
+	n, err := v.rc.Read(p)
+	if n > 0 {
+		v.h.Write(p[:n])
+		v.remaining -= int64(n)
+		if v.remaining <= 0 && !strings.EqualFold(hex.EncodeToString(v.h.Sum(nil)), v.want) {
+			return 0, ErrChecksumMismatch
+		}
+	}
+	return n, err
+}
+
+func (v *verifyReader) Close() error {
+	return v.rc.Close()
+}
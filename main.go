@@ -3,6 +3,8 @@ package main
 import (
 	"bytes"
 	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"os"
@@ -15,8 +17,9 @@ import (
 )
 
 var (
-	port      = 8080
-	clientTTL = 1 * time.Hour
+	port       = 8080
+	clientTTL  = 1 * time.Hour
+	configFile = ""
 )
 
 func init() {
@@ -27,11 +30,60 @@ func init() {
 			port = newPort
 		}
 	}
+	configFile = os.Getenv("CONFIG_FILE")
+}
+
+// serverConfig holds client options for every user. Defaults apply to all
+// users, Users overrides them per username.
+type serverConfig struct {
+	Defaults json.RawMessage            `json:"defaults"`
+	Users    map[string]json.RawMessage `json:"users"`
+}
+
+func loadServerConfig(path string) (*serverConfig, error) {
+	config := &serverConfig{}
+	if path == "" {
+		return config, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(data, config)
+	if err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// apply sets the options configured for username on c.
+func (s *serverConfig) apply(c *client.Config, username string) error {
+	if len(s.Defaults) > 0 {
+		err := json.Unmarshal(s.Defaults, c)
+		if err != nil {
+			return err
+		}
+	}
+	if user, ok := s.Users[username]; ok {
+		err := json.Unmarshal(user, c)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 type authHandler struct {
 	clients *ttlcache.Cache[string, *client.Client]
-	mu      sync.Mutex
+	config  *serverConfig
+	// userLocks holds a mutex per username signing in, guarded by mu
+	userLocks map[string]*userLock
+	mu        sync.Mutex
+}
+
+type userLock struct {
+	sync.Mutex
+	refs int
 }
 
 type userInfo struct {
@@ -61,57 +113,95 @@ func parseBasicAuth(r *http.Request) (*userInfo, error) {
 	}, nil
 }
 
-func (a *authHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	u, err := parseBasicAuth(r)
-	if err != nil {
-		w.Header().Set("WWW-Authenticate", `Basic realm="pikpakdav"`)
-		w.WriteHeader(http.StatusUnauthorized)
-		w.Write([]byte("401 Unauthorized"))
-		return
-	}
+var errSignInFailed = errors.New("sign in failed")
 
+// lockUser locks the mutex serializing sign ins of username and returns a
+// function unlocking it. Mutexes are dropped once unused, so that arbitrary
+// usernames do not pile up.
+func (a *authHandler) lockUser(username string) func() {
 	a.mu.Lock()
+	if a.userLocks == nil {
+		a.userLocks = map[string]*userLock{}
+	}
+	l := a.userLocks[username]
+	if l == nil {
+		l = &userLock{}
+		a.userLocks[username] = l
+	}
+	l.refs++
+	a.mu.Unlock()
+
+	l.Lock()
+	return func() {
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		l.Unlock()
+		l.refs--
+		if l.refs == 0 {
+			delete(a.userLocks, username)
+		}
+	}
+}
+
+// client returns the client of u, signing in if there is none yet or the
+// password changed. Users sign in independently of each other.
+func (a *authHandler) client(u *userInfo) (*client.Client, error) {
+	unlock := a.lockUser(u.Username)
+	defer unlock()
+
 	var c *client.Client
 	item := a.clients.Get(u.Username)
 	if item != nil {
 		c = item.Value()
 	}
+	if c != nil && c.Config.User.Password == u.Password {
+		return c, nil
+	}
+
 	if c == nil {
 		c = &client.Client{}
-		c.Config.User.Username = u.Username
-		c.Config.User.Password = u.Password
-		uc, err := c.User()
+		err := a.config.apply(&c.Config, u.Username)
 		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			w.Write([]byte("500 Internal Server Error"))
-			return
+			return nil, err
 		}
-		err = uc.SignIn()
-		if err != nil {
-			w.WriteHeader(http.StatusUnauthorized)
-			w.Write([]byte("401 Unauthorized"))
-			return
-		}
-		a.clients.Set(u.Username, c, clientTTL)
-	} else if c.Config.User.Password != u.Password {
-		c.Config.User.Password = u.Password
+		c.Config.User.Username = u.Username
+	} else {
 		c.State.User.AccessToken = ""
 		c.State.User.RefreshToken = ""
-		uc, err := c.User()
-		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			w.Write([]byte("500 Internal Server Error"))
-			return
-		}
-		err = uc.SignIn()
-		if err != nil {
-			w.WriteHeader(http.StatusUnauthorized)
-			w.Write([]byte("401 Unauthorized"))
-			return
-		}
-		a.clients.Set(u.Username, c, clientTTL)
 	}
-	a.mu.Unlock()
+	c.Config.User.Password = u.Password
+	uc, err := c.User()
+	if err != nil {
+		return nil, err
+	}
+	err = uc.SignIn()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errSignInFailed, err)
+	}
+	a.clients.Set(u.Username, c, clientTTL)
+	return c, nil
+}
+
+func (a *authHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	u, err := parseBasicAuth(r)
+	if err != nil {
+		w.Header().Set("WWW-Authenticate", `Basic realm="pikpakdav"`)
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte("401 Unauthorized"))
+		return
+	}
+
+	c, err := a.client(u)
+	if errors.Is(err, errSignInFailed) {
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte("401 Unauthorized"))
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("500 Internal Server Error"))
+		return
+	}
 
 	d, err := c.Drive()
 	if err != nil {
@@ -131,8 +221,22 @@ func (a *authHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "upload" {
+		err := uploadCommand(os.Args[2:])
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	config, err := loadServerConfig(configFile)
+	if err != nil {
+		panic(err)
+	}
 	http.Handle("/", &authHandler{
 		clients: ttlcache.New[string, *client.Client](),
+		config:  config,
 	})
 	fmt.Println("Listening on port", port)
 	panic(http.ListenAndServe(fmt.Sprintf(":%d", port), nil))
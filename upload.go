@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/gyf304/pikpakdav/client"
+	"github.com/gyf304/pikpakdav/client/gcid"
+)
+
+// uploadCommand uploads a local file:
+//
+//	pikpakdav upload [-u username] [-p password] <local file> <remote path>
+//
+// If the remote path ends with a slash, the file keeps its local name.
+func uploadCommand(args []string) error {
+	flags := flag.NewFlagSet("upload", flag.ExitOnError)
+	username := flags.String("u", os.Getenv("PIKPAK_USERNAME"), "PikPak username")
+	password := flags.String("p", os.Getenv("PIKPAK_PASSWORD"), "PikPak password")
+	flags.Parse(args)
+
+	if flags.NArg() != 2 {
+		return errors.New("usage: pikpakdav upload [-u username] [-p password] <local file> <remote path>")
+	}
+	localPath, remotePath := flags.Arg(0), flags.Arg(1)
+	if strings.HasSuffix(remotePath, "/") {
+		remotePath += path.Base(localPath)
+	}
+	if !strings.HasPrefix(remotePath, "/") {
+		remotePath = "/" + remotePath
+	}
+
+	f, err := os.Open(localPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	size := stat.Size()
+
+	// the hash lets PikPak skip the transfer if it already has the content
+	hash, err := gcid.Sum(f, size)
+	if err != nil {
+		return err
+	}
+	_, err = f.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+
+	config, err := loadServerConfig(configFile)
+	if err != nil {
+		return err
+	}
+	c := &client.Client{}
+	err = config.apply(&c.Config, *username)
+	if err != nil {
+		return err
+	}
+	c.Config.User.Username = *username
+	c.Config.User.Password = *password
+	uc, err := c.User()
+	if err != nil {
+		return err
+	}
+	err = uc.SignIn()
+	if err != nil {
+		return err
+	}
+	d, err := c.Drive()
+	if err != nil {
+		return err
+	}
+	fs, err := d.FileSystem()
+	if err != nil {
+		return err
+	}
+
+	mode, err := fs.Upload(context.Background(), remotePath, f, size, hash)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("uploaded %s to %s (%s)\n", localPath, remotePath, mode)
+	return nil
+}